@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadURLTTL is how long a signed download URL stays valid. The artifact
+// itself is kept a little longer so a link opened at the last moment works.
+const (
+	downloadURLTTL = 5 * time.Minute
+	artifactTTL    = downloadURLTTL + time.Minute
+)
+
+// Artifact is a generated file, such as a kubeconfig, held for one owner.
+type Artifact struct {
+	Cluster   string
+	Owner     string
+	Filename  string
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+// artifactStore keeps artifacts by the random ID of their download URL.
+type artifactStore interface {
+	put(ctx context.Context, id string, a Artifact) error
+	// get returns the artifact if it exists, has not expired and was stored
+	// for cluster and owner.
+	get(ctx context.Context, id, cluster, owner string) (Artifact, bool, error)
+}
+
+// artifactStoreFor returns the store of the running config: in memory, or
+// Secrets shared by the replicas with coordination, so that a download link
+// works whichever replica it reaches.
+func artifactStoreFor(cfg *Config) artifactStore {
+	if cfg.Coordination.Enabled {
+		return clusterArtifactStore{}
+	}
+	return memoryArtifacts
+}
+
+// valid reports whether the artifact may be handed out for cluster and owner.
+func (a Artifact) valid(cluster, owner string) bool {
+	return a.Cluster == cluster && a.Owner == owner && time.Now().Before(a.ExpiresAt)
+}
+
+type memoryArtifactStore struct {
+	mu        sync.Mutex
+	artifacts map[string]Artifact
+}
+
+var memoryArtifacts = &memoryArtifactStore{artifacts: map[string]Artifact{}}
+
+func (s *memoryArtifactStore) put(ctx context.Context, id string, a Artifact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, existing := range s.artifacts {
+		if now.After(existing.ExpiresAt) {
+			delete(s.artifacts, k)
+		}
+	}
+	s.artifacts[id] = a
+	return nil
+}
+
+func (s *memoryArtifactStore) get(ctx context.Context, id, cluster, owner string) (Artifact, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.artifacts[id]
+	if !ok || !a.valid(cluster, owner) {
+		return Artifact{}, false, nil
+	}
+	return a, true, nil
+}
+
+// clusterArtifactStore keeps each artifact in a Secret in
+// coordination.namespace, like the idempotency keys. The leader deletes them
+// once they expire.
+type clusterArtifactStore struct{}
+
+// labelDownload marks the Secrets of the artifact store.
+const labelDownload = "kubehatch.io/download"
+
+func artifactSecretName(id string) string {
+	return "kubehatch-download-" + id
+}
+
+func (clusterArtifactStore) put(ctx context.Context, id string, a Artifact) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	var secret SecretJSON
+	secret.APIVersion, secret.Kind = "v1", "Secret"
+	secret.Metadata.Name = artifactSecretName(id)
+	secret.Metadata.Labels = map[string]string{labelDownload: "true"}
+	secret.Metadata.Annotations = map[string]string{annotationDeleteAfter: a.ExpiresAt.UTC().Format(time.RFC3339)}
+	secret.Data = map[string][]byte{"artifact": data}
+	manifest, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	if out, err := coordinationKubectl(ctx, manifest, "create", "-f", "-"); err != nil {
+		return fmt.Errorf("storing download: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+func (clusterArtifactStore) get(ctx context.Context, id, cluster, owner string) (Artifact, bool, error) {
+	out, err := coordinationKubectl(ctx, nil, "get", "secret", artifactSecretName(id), "-o", "json")
+	if err != nil {
+		if strings.Contains(string(out), "NotFound") {
+			return Artifact{}, false, nil
+		}
+		return Artifact{}, false, fmt.Errorf("getting download: %v, output: %s", err, string(out))
+	}
+	var secret SecretJSON
+	var a Artifact
+	if err := json.Unmarshal(out, &secret); err != nil {
+		return Artifact{}, false, fmt.Errorf("parsing download: %v", err)
+	}
+	if err := json.Unmarshal(secret.Data["artifact"], &a); err != nil {
+		return Artifact{}, false, fmt.Errorf("parsing download: %v", err)
+	}
+	if !a.valid(cluster, owner) {
+		return Artifact{}, false, nil
+	}
+	return a, true, nil
+}
+
+// expireDownloads deletes the Secrets of artifacts past their expiry.
+func expireDownloads(ctx context.Context) {
+	expireSecrets(ctx, labelDownload, "download")
+}
+
+var (
+	signingKeyOnce sync.Once
+	signingKey     []byte
+)
+
+// downloadSigningKey returns the HMAC key for download URLs. Without
+// downloads.signingKey a random key is used, so URLs do not survive a
+// restart (neither do the artifacts they point to). Coordination requires the
+// key, since every replica must accept the URLs of the others.
+func downloadSigningKey() []byte {
+	signingKeyOnce.Do(func() {
+		if key := currentConfig().Downloads.SigningKey; key != "" {
+			signingKey = []byte(key)
+			return
+		}
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			fatal("failed to generate download signing key", "err", err)
+		}
+	})
+	return signingKey
+}
+
+func signDownload(id, cluster, owner string, expires int64) string {
+	mac := hmac.New(sha256.New, downloadSigningKey())
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", id, cluster, owner, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// storeDownload stores an artifact for the owner and returns a signed,
+// time-limited URL path for it. Every artifact gets its own URL, so earlier
+// links keep working.
+func storeDownload(ctx context.Context, cluster, owner, filename string, data []byte) (string, time.Time, error) {
+	expiresAt := time.Now().Add(downloadURLTTL)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		fatal("failed to generate download ID", "err", err)
+	}
+	id := hex.EncodeToString(b)
+	err := artifactStoreFor(currentConfig()).put(ctx, id, Artifact{
+		Cluster:   cluster,
+		Owner:     owner,
+		Filename:  filename,
+		Data:      data,
+		ExpiresAt: time.Now().Add(artifactTTL),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	q := url.Values{}
+	q.Set("id", id)
+	q.Set("cluster", cluster)
+	q.Set("owner", owner)
+	q.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	q.Set("sig", signDownload(id, cluster, owner, expiresAt.Unix()))
+	return "/download?" + q.Encode(), expiresAt, nil
+}
+
+// downloadHandler serves an artifact from a signed URL. The signature and
+// expiry are checked first, then the authenticated user must be the owner the
+// URL was issued to.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, cluster, owner := q.Get("id"), q.Get("cluster"), q.Get("owner")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if id == "" || cluster == "" || owner == "" || err != nil {
+		http.Error(w, "Invalid download link", http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(signDownload(id, cluster, owner, expires))) {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Download link expired", http.StatusGone)
+		return
+	}
+	currentUser := getUserFromRequest(r)
+	if currentUser != owner {
+		logger(r.Context()).Warn("download denied", "user", currentUser, "cluster", cluster, "owner", owner)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	a, ok, err := artifactStoreFor(currentConfig()).get(r.Context(), id, cluster, owner)
+	if err != nil {
+		logger(r.Context()).Error("reading download failed", "cluster", cluster, "err", err)
+		http.Error(w, "Error reading download", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Download no longer available", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", a.Filename))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(a.Data)
+}
+
+// downloadURLHandler mints a kubeconfig like getKubeconfigHandler, stores it
+// as an artifact and returns a signed URL for it instead of the content.
+func downloadURLHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+	ctx := r.Context()
+	w, done := auditAction(w, r, AuditKubeconfig, clusterName, kubeconfigAuditParams(r))
+	defer done()
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
+
+	role, ttl, err := parseCredentialRequest(r, currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	opts, err := parseKubeconfigOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kcData, _, err := buildUserKubeconfig(ctx, hostKubeconfig, clusterName, currentUser, role, ttl, opts)
+	if err != nil {
+		logger(ctx).Error("building kubeconfig failed", "cluster", clusterName, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	downloadURL, expiresAt, err := storeDownload(ctx, clusterName, currentUser, fmt.Sprintf("kubeconfig-%s.yaml", clusterName), kcData)
+	if err != nil {
+		logger(ctx).Error("storing download failed", "cluster", clusterName, "err", err)
+		http.Error(w, "Error storing download: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":       downloadURL,
+		"expiresAt": expiresAt,
+	})
+}
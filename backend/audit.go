@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditCreate           = "create"
+	AuditUpdate           = "update"
+	AuditDelete           = "delete"
+	AuditKubeconfig       = "kubeconfig.download"
+	AuditCredentialRevoke = "credential.revoke"
+	AuditOperationCancel  = "operation.cancel"
+	AuditOwnershipChange  = "ownership.change"
+	AuditTTLChange        = "ttl.change"
+)
+
+// auditSystemActor is the actor of changes KubeHatch makes on its own, such as
+// applying failedClusters.policy.
+const auditSystemActor = "system:kubehatch"
+
+const (
+	auditOutcomeSuccess    = "success"
+	auditOutcomeFailure    = "failure"
+	maxAuditRecordsInQuery = 1000
+)
+
+// auditMemoryLimit is how many records are kept in memory for GET /api/audit.
+const auditMemoryLimit = 10000
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time         time.Time              `json:"time"`
+	RequestID    string                 `json:"requestId,omitempty"`
+	Actor        string                 `json:"actor"`
+	SourceIP     string                 `json:"sourceIP"`
+	ForwardedFor string                 `json:"forwardedFor,omitempty"`
+	Action       string                 `json:"action"`
+	Cluster      string                 `json:"cluster,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Outcome      string                 `json:"outcome"`
+	Status       int                    `json:"status,omitempty"`
+}
+
+// auditLog appends records to a JSON lines sink and keeps the most recent
+// ones in memory for querying.
+type auditLog struct {
+	mu      sync.Mutex
+	sink    io.Writer
+	records []AuditRecord
+}
+
+// audit is opened in main once the config is loaded.
+var audit *auditLog
+
+// newAuditLog opens the sink at path: a file path, or "stdout". Records
+// already in the file are loaded so that queries cover earlier runs.
+func newAuditLog(path string) *auditLog {
+	a := &auditLog{sink: os.Stdout}
+	if path == "" || path == "stdout" {
+		return a
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+				a.records = append(a.records, rec)
+			}
+		}
+		f.Close()
+		if len(a.records) > auditMemoryLimit {
+			a.records = a.records[len(a.records)-auditMemoryLimit:]
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fatal("failed to open audit log", "path", path, "err", err)
+	}
+	a.sink = f
+	return a
+}
+
+func (a *auditLog) record(rec AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		rootLogger.Error("encoding audit record failed", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.sink.Write(append(line, '\n')); err != nil {
+		rootLogger.Error("writing audit record failed", "err", err)
+	}
+	a.records = append(a.records, rec)
+	if len(a.records) > auditMemoryLimit {
+		a.records = a.records[len(a.records)-auditMemoryLimit:]
+	}
+}
+
+// query returns matching records, newest first.
+func (a *auditLog) query(actor, cluster string, since, until time.Time, limit int) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []AuditRecord{}
+	for i := len(a.records) - 1; i >= 0 && len(result) < limit; i-- {
+		rec := a.records[i]
+		if actor != "" && rec.Actor != actor {
+			continue
+		}
+		if cluster != "" && rec.Cluster != cluster {
+			continue
+		}
+		if !since.IsZero() && rec.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && rec.Time.After(until) {
+			continue
+		}
+		result = append(result, rec)
+	}
+	return result
+}
+
+// auditAction wraps w so that the outcome of the handler is recorded when the
+// returned func runs. params may be filled in by the handler until then.
+//
+//	w, done := auditAction(w, r, AuditDelete, clusterName, nil)
+//	defer done()
+func auditAction(w http.ResponseWriter, r *http.Request, action, clusterName string, params map[string]interface{}) (http.ResponseWriter, func()) {
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, func() {
+		status := responseStatus(sw)
+		outcome := auditOutcomeSuccess
+		if status >= 400 {
+			outcome = auditOutcomeFailure
+		}
+		if len(params) == 0 {
+			params = nil
+		}
+		audit.record(AuditRecord{
+			Time:         time.Now().UTC(),
+			RequestID:    requestIDFromContext(r.Context()),
+			Actor:        getUserFromRequest(r),
+			SourceIP:     remoteIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Action:       action,
+			Cluster:      clusterName,
+			Parameters:   params,
+			Outcome:      outcome,
+			Status:       status,
+		})
+	}
+}
+
+// auditEvent records a change that follows from another action, such as the
+// new owner of a claimed pool cluster. It carries the request ID of ctx, if
+// any, but no source address or status.
+func auditEvent(ctx context.Context, actor, action, clusterName string, params map[string]interface{}) {
+	audit.record(AuditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  requestIDFromContext(ctx),
+		Actor:      actor,
+		Action:     action,
+		Cluster:    clusterName,
+		Parameters: params,
+		Outcome:    auditOutcomeSuccess,
+	})
+}
+
+// remoteIP returns the address of the direct peer. X-Forwarded-For is
+// recorded separately since clients can set it.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditHandler serves GET /api/audit?actor=&cluster=&since=&until=&limit= to
+// admins. since and until are RFC 3339 timestamps.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUser := getUserFromRequest(r)
+	if !isAdminUser(currentUser) {
+		logger(r.Context()).Warn("audit log access denied", "user", currentUser)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid until: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := maxAuditRecordsInQuery
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	records := audit.query(strings.TrimSpace(q.Get("actor")), strings.TrimSpace(q.Get("cluster")), since, until, limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
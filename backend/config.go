@@ -0,0 +1,608 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigPath is read when KUBEHATCH_CONFIG is unset and the file
+// exists, e.g. from a mounted ConfigMap.
+const defaultConfigPath = "/etc/kubehatch/config.yaml"
+
+// Config is the backend configuration. It is read from a YAML file and then
+// overridden by KUBEHATCH_* environment variables.
+type Config struct {
+	ListenAddr     string   `yaml:"listenAddr" json:"listenAddr"`
+	HostKubeconfig string   `yaml:"hostKubeconfig" json:"-"`
+	AdminUsers     []string `yaml:"adminUsers" json:"adminUsers"`
+	CORSOrigin     string   `yaml:"corsOrigin" json:"corsOrigin"`
+	HAReplicas     int      `yaml:"haReplicas" json:"haReplicas"`
+
+	Timeouts    TimeoutsConfig    `yaml:"timeouts" json:"timeouts"`
+	Credentials CredentialsConfig `yaml:"credentials" json:"credentials"`
+	Ingress     IngressConfig     `yaml:"ingress" json:"ingress"`
+	NodePort    NodePortConfig    `yaml:"nodePort" json:"nodePort"`
+	Logging     LoggingConfig     `yaml:"logging" json:"logging"`
+	Audit       AuditConfig       `yaml:"audit" json:"audit"`
+	Uploads     UploadsConfig     `yaml:"uploads" json:"uploads"`
+
+	FailedClusters FailedClustersConfig `yaml:"failedClusters" json:"failedClusters"`
+	Pools          []PoolConfig         `yaml:"pools" json:"pools"`
+	Idempotency    IdempotencyConfig    `yaml:"idempotency" json:"idempotency"`
+	Queue          QueueConfig          `yaml:"queue" json:"queue"`
+	Coordination   CoordinationConfig   `yaml:"coordination" json:"coordination"`
+	Downloads      DownloadsConfig      `yaml:"downloads" json:"-"`
+}
+
+// TimeoutsConfig bounds the waits during provisioning.
+type TimeoutsConfig struct {
+	// ReadyWait is how long create waits after install for the control-plane
+	// pods to become ready.
+	ReadyWait    Duration `yaml:"readyWait" json:"readyWait"`
+	ConnectRetry Duration `yaml:"connectRetry" json:"connectRetry"`
+	SecretRetry  Duration `yaml:"secretRetry" json:"secretRetry"`
+	LoadBalancer Duration `yaml:"loadBalancer" json:"loadBalancer"`
+	// Command is the longest any single kubectl or vcluster call may run.
+	Command Duration `yaml:"command" json:"command"`
+	// Stages are deadlines for the stages of a create or delete, by stage
+	// name. Stages without one only end with the operation.
+	Stages map[string]Duration `yaml:"stages" json:"stages"`
+}
+
+// defaultStageTimeouts apply to the stages the config does not mention. A
+// stage set to 0s has no deadline.
+var defaultStageTimeouts = map[string]Duration{
+	"node-address": {time.Minute},
+	"namespace":    {time.Minute},
+	"install":      {10 * time.Minute},
+	"upgrade":      {10 * time.Minute},
+	"expose":       {2 * time.Minute},
+	"kubeconfig":   {10 * time.Minute},
+	"ready":        {2 * time.Minute},
+	"credential":   {2 * time.Minute},
+	"uninstall":    {10 * time.Minute},
+}
+
+// operationStages are the stages of creates, updates and deletes that can
+// have a deadline.
+var operationStages = map[string]bool{
+	"validate": true, "claim": true, "node-address": true, "render-config": true, "namespace": true, "queued": true, "install": true, "upgrade": true, "expose": true,
+	"wait": true, "kubeconfig": true, "ready": true, "credential": true, "uninstall": true,
+}
+
+// CredentialsConfig bounds the lifetime of per-user credentials.
+type CredentialsConfig struct {
+	DefaultTTL Duration `yaml:"defaultTTL" json:"defaultTTL"`
+	MinTTL     Duration `yaml:"minTTL" json:"minTTL"`
+	MaxTTL     Duration `yaml:"maxTTL" json:"maxTTL"`
+}
+
+// IngressConfig exposes clusters as <name>.<BaseDomain> through an Ingress of
+// ClassName. Ingress exposure is only offered when BaseDomain is set.
+type IngressConfig struct {
+	BaseDomain string `yaml:"baseDomain" json:"baseDomain"`
+	ClassName  string `yaml:"className" json:"className"`
+}
+
+// NodePortConfig picks the address NodePort clusters are reached on: Address
+// if set, else a ready node's address of the first of AddressTypes it has.
+type NodePortConfig struct {
+	Address      string   `yaml:"address" json:"address"`
+	AddressTypes []string `yaml:"addressTypes" json:"addressTypes"`
+}
+
+// LoggingConfig sets the log level (debug, info, warn, error) and format
+// (text or json).
+type LoggingConfig struct {
+	Level  string `yaml:"level" json:"level"`
+	Format string `yaml:"format" json:"format"`
+}
+
+type AuditConfig struct {
+	// Log is a file path or "stdout".
+	Log string `yaml:"log" json:"log"`
+}
+
+// FailedClustersConfig decides what happens to a cluster whose create fails
+// after its namespace was made: keep it, shown as Failed, for TTL so that it
+// can be debugged, or delete it immediately.
+type FailedClustersConfig struct {
+	Policy string   `yaml:"policy" json:"policy"`
+	TTL    Duration `yaml:"ttl" json:"ttl"`
+}
+
+// PoolConfig is a warm pool: Size clusters of one template kept ready on the
+// default host, to be claimed by creates that name the pool.
+type PoolConfig struct {
+	Name     string `yaml:"name" json:"name"`
+	Size     int    `yaml:"size" json:"size"`
+	HA       bool   `yaml:"ha" json:"ha"`
+	Exposure string `yaml:"exposure" json:"exposure"`
+}
+
+// IdempotencyConfig sets how long the result of a create is kept for retries
+// that carry the same idempotency key.
+type IdempotencyConfig struct {
+	Window Duration `yaml:"window" json:"window"`
+}
+
+// QueueConfig limits how many clusters are installed at once. Creates beyond
+// the limits wait in line, by priority and then in order of arrival.
+type QueueConfig struct {
+	// MaxConcurrent and MaxPerHost bound the installs overall and per host
+	// cluster; 0 means no limit.
+	MaxConcurrent int              `yaml:"maxConcurrent" json:"maxConcurrent"`
+	MaxPerHost    int              `yaml:"maxPerHost" json:"maxPerHost"`
+	Priorities    []PriorityConfig `yaml:"priorities" json:"priorities"`
+}
+
+// PriorityConfig gives a team of users a queue priority. Higher goes first;
+// users in no team have priority 0.
+type PriorityConfig struct {
+	Name     string   `yaml:"name" json:"name"`
+	Users    []string `yaml:"users" json:"users"`
+	Priority int      `yaml:"priority" json:"priority"`
+}
+
+// CoordinationConfig lets several replicas run side by side. They elect a
+// leader for the background loops, lock clusters and share idempotency keys
+// through Leases and Secrets in Namespace on the default host.
+type CoordinationConfig struct {
+	Enabled   bool   `yaml:"enabled" json:"enabled"`
+	Namespace string `yaml:"namespace" json:"namespace"`
+	// LeaseDuration is how long a replica holds the leadership or a cluster
+	// lock without renewing it.
+	LeaseDuration Duration `yaml:"leaseDuration" json:"leaseDuration"`
+}
+
+// maxPoolName keeps vcluster-<pool>-<suffix> within a namespace name.
+const maxPoolName = 40
+
+// UploadsConfig limits what an uploaded host kubeconfig may contain.
+type UploadsConfig struct {
+	// AllowedExecCommands are the exec credential plugins an uploaded host
+	// kubeconfig may run, each a command and the arguments its args must
+	// start with, e.g. "aws eks get-token" or "gke-gcloud-auth-plugin".
+	// Plugins run inside the backend container, so none are allowed by
+	// default.
+	AllowedExecCommands []string `yaml:"allowedExecCommands" json:"allowedExecCommands"`
+}
+
+// DownloadsConfig holds the key that signs kubeconfig download URLs.
+type DownloadsConfig struct {
+	SigningKey string `yaml:"signingKey"`
+}
+
+// Duration is a time.Duration written as a Go duration string ("90s", "3m").
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		ListenAddr:     ":8081",
+		HostKubeconfig: "/var/secrets/kubeconfig",
+		AdminUsers:     []string{"admin"},
+		CORSOrigin:     "*",
+		HAReplicas:     3,
+	}
+	cfg.Timeouts.ReadyWait.Duration = 10 * time.Minute
+	cfg.Timeouts.ConnectRetry.Duration = 3 * time.Minute
+	cfg.Timeouts.SecretRetry.Duration = 2 * time.Minute
+	cfg.Timeouts.LoadBalancer.Duration = 3 * time.Minute
+	cfg.Timeouts.Command.Duration = 10 * time.Minute
+	cfg.Credentials.DefaultTTL.Duration = 8 * time.Hour
+	cfg.Credentials.MinTTL.Duration = 10 * time.Minute
+	cfg.Credentials.MaxTTL.Duration = 24 * time.Hour
+	cfg.Ingress.ClassName = "nginx"
+	cfg.NodePort.AddressTypes = []string{"ExternalIP", "InternalIP"}
+	cfg.Logging.Level = "info"
+	cfg.Logging.Format = "json"
+	cfg.Audit.Log = "stdout"
+	cfg.FailedClusters.Policy = FailurePolicyKeep
+	cfg.FailedClusters.TTL.Duration = time.Hour
+	cfg.Idempotency.Window.Duration = 24 * time.Hour
+	cfg.Queue.MaxConcurrent = 4
+	cfg.Queue.MaxPerHost = 2
+	cfg.Coordination.Namespace = "default"
+	cfg.Coordination.LeaseDuration.Duration = 15 * time.Second
+	return cfg
+}
+
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns the effective configuration. Callers should read it
+// once per operation so a reload does not change values halfway through.
+func currentConfig() *Config {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return defaultConfig()
+}
+
+// loadConfig reads the file named by KUBEHATCH_CONFIG (or defaultConfigPath
+// if present), applies environment overrides and validates the result.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	path := os.Getenv("KUBEHATCH_CONFIG")
+	if path == "" {
+		if _, err := os.Stat(defaultConfigPath); err == nil {
+			path = defaultConfigPath
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %v", path, err)
+		}
+	}
+	if cfg.Timeouts.Stages == nil {
+		cfg.Timeouts.Stages = map[string]Duration{}
+	}
+	for stage, d := range defaultStageTimeouts {
+		if _, ok := cfg.Timeouts.Stages[stage]; !ok {
+			cfg.Timeouts.Stages[stage] = d
+		}
+	}
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return cfg, nil
+}
+
+// applyEnvOverrides applies the KUBEHATCH_* variables that are set.
+func applyEnvOverrides(cfg *Config) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = splitList(v)
+		}
+	}
+	num := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	flag := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+	dur := func(name string, dst *Duration) {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			dst.Duration = d
+		}
+	}
+
+	str("KUBEHATCH_LISTEN_ADDR", &cfg.ListenAddr)
+	str("KUBEHATCH_HOST_KUBECONFIG", &cfg.HostKubeconfig)
+	list("KUBEHATCH_ADMIN_USERS", &cfg.AdminUsers)
+	str("KUBEHATCH_CORS_ORIGIN", &cfg.CORSOrigin)
+	num("KUBEHATCH_HA_REPLICAS", &cfg.HAReplicas)
+	dur("KUBEHATCH_READY_WAIT", &cfg.Timeouts.ReadyWait)
+	dur("KUBEHATCH_CONNECT_TIMEOUT", &cfg.Timeouts.ConnectRetry)
+	dur("KUBEHATCH_SECRET_TIMEOUT", &cfg.Timeouts.SecretRetry)
+	dur("KUBEHATCH_LOADBALANCER_TIMEOUT", &cfg.Timeouts.LoadBalancer)
+	dur("KUBEHATCH_COMMAND_TIMEOUT", &cfg.Timeouts.Command)
+	// KUBEHATCH_STAGE_TIMEOUTS=install=15m,kubeconfig=5m
+	if v, ok := os.LookupEnv("KUBEHATCH_STAGE_TIMEOUTS"); ok {
+		for _, item := range splitList(v) {
+			stage, raw, _ := strings.Cut(item, "=")
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("KUBEHATCH_STAGE_TIMEOUTS: %s: %v", stage, err))
+				continue
+			}
+			cfg.Timeouts.Stages[stage] = Duration{d}
+		}
+	}
+	dur("KUBEHATCH_CREDENTIAL_DEFAULT_TTL", &cfg.Credentials.DefaultTTL)
+	dur("KUBEHATCH_CREDENTIAL_MIN_TTL", &cfg.Credentials.MinTTL)
+	dur("KUBEHATCH_CREDENTIAL_MAX_TTL", &cfg.Credentials.MaxTTL)
+	str("KUBEHATCH_INGRESS_BASE_DOMAIN", &cfg.Ingress.BaseDomain)
+	str("KUBEHATCH_INGRESS_CLASS", &cfg.Ingress.ClassName)
+	str("KUBEHATCH_NODEPORT_ADDRESS", &cfg.NodePort.Address)
+	list("KUBEHATCH_NODEPORT_ADDRESS_TYPES", &cfg.NodePort.AddressTypes)
+	str("KUBEHATCH_LOG_LEVEL", &cfg.Logging.Level)
+	str("KUBEHATCH_LOG_FORMAT", &cfg.Logging.Format)
+	str("KUBEHATCH_AUDIT_LOG", &cfg.Audit.Log)
+	str("KUBEHATCH_FAILED_CLUSTER_POLICY", &cfg.FailedClusters.Policy)
+	dur("KUBEHATCH_FAILED_CLUSTER_TTL", &cfg.FailedClusters.TTL)
+	dur("KUBEHATCH_IDEMPOTENCY_WINDOW", &cfg.Idempotency.Window)
+	num("KUBEHATCH_QUEUE_MAX_CONCURRENT", &cfg.Queue.MaxConcurrent)
+	num("KUBEHATCH_QUEUE_MAX_PER_HOST", &cfg.Queue.MaxPerHost)
+	flag("KUBEHATCH_COORDINATION", &cfg.Coordination.Enabled)
+	str("KUBEHATCH_COORDINATION_NAMESPACE", &cfg.Coordination.Namespace)
+	dur("KUBEHATCH_LEASE_DURATION", &cfg.Coordination.LeaseDuration)
+	list("KUBEHATCH_UPLOAD_ALLOWED_EXEC_COMMANDS", &cfg.Uploads.AllowedExecCommands)
+	str("KUBEHATCH_DOWNLOAD_SIGNING_KEY", &cfg.Downloads.SigningKey)
+	return errors.Join(errs...)
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var validNodeAddressTypes = map[string]bool{
+	"ExternalIP": true, "InternalIP": true, "ExternalDNS": true, "InternalDNS": true, "Hostname": true,
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listenAddr: %v", err))
+	}
+	if c.CORSOrigin == "" {
+		errs = append(errs, errors.New("corsOrigin must not be empty"))
+	}
+	if c.HAReplicas < 2 {
+		errs = append(errs, fmt.Errorf("haReplicas must be at least 2, got %d", c.HAReplicas))
+	}
+	for name, d := range map[string]Duration{
+		"timeouts.readyWait":    c.Timeouts.ReadyWait,
+		"timeouts.connectRetry": c.Timeouts.ConnectRetry,
+		"timeouts.secretRetry":  c.Timeouts.SecretRetry,
+		"timeouts.loadBalancer": c.Timeouts.LoadBalancer,
+		"timeouts.command":      c.Timeouts.Command,
+		"credentials.minTTL":    c.Credentials.MinTTL,
+		"failedClusters.ttl":    c.FailedClusters.TTL,
+		"idempotency.window":    c.Idempotency.Window,
+	} {
+		if d.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	for stage, d := range c.Timeouts.Stages {
+		if !operationStages[stage] {
+			errs = append(errs, fmt.Errorf("timeouts.stages: unknown stage %q", stage))
+		} else if d.Duration < 0 {
+			errs = append(errs, fmt.Errorf("timeouts.stages.%s must not be negative", stage))
+		}
+	}
+	creds := c.Credentials
+	if creds.DefaultTTL.Duration < creds.MinTTL.Duration || creds.DefaultTTL.Duration > creds.MaxTTL.Duration {
+		errs = append(errs, fmt.Errorf("credentials.defaultTTL %s must be between minTTL %s and maxTTL %s", creds.DefaultTTL, creds.MinTTL, creds.MaxTTL))
+	}
+	if c.Queue.MaxConcurrent < 0 || c.Queue.MaxPerHost < 0 {
+		errs = append(errs, errors.New("queue.maxConcurrent and queue.maxPerHost must not be negative"))
+	}
+	if c.Coordination.Enabled && c.Coordination.Namespace == "" {
+		errs = append(errs, errors.New("coordination.namespace must be set when coordination is enabled"))
+	}
+	if c.Coordination.Enabled && c.Downloads.SigningKey == "" {
+		errs = append(errs, errors.New("downloads.signingKey must be set when coordination is enabled (KUBEHATCH_DOWNLOAD_SIGNING_KEY, from the kubehatch-download-signing-key Secret in k8s/backenddeploy.yaml)"))
+	}
+	if c.Coordination.LeaseDuration.Duration < 3*time.Second {
+		errs = append(errs, fmt.Errorf("coordination.leaseDuration %s must be at least 3s", c.Coordination.LeaseDuration))
+	}
+	for i, p := range c.Queue.Priorities {
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("queue.priorities[%d]: name must not be empty", i))
+		}
+	}
+	pools := map[string]bool{}
+	for i, pool := range c.Pools {
+		switch {
+		case !validName.MatchString(pool.Name) || strings.Contains(pool.Name, ".") || len(pool.Name) > maxPoolName:
+			errs = append(errs, fmt.Errorf("pools[%d]: name %q must be a DNS label of at most %d characters", i, pool.Name, maxPoolName))
+		case pools[pool.Name]:
+			errs = append(errs, fmt.Errorf("pools[%d]: duplicate name %q", i, pool.Name))
+		}
+		pools[pool.Name] = true
+		if pool.Size < 0 {
+			errs = append(errs, fmt.Errorf("pools.%s.size must not be negative", pool.Name))
+		}
+		if pool.Exposure != "" && !validExposures[pool.Exposure] {
+			errs = append(errs, fmt.Errorf("pools.%s.exposure: unknown exposure %q", pool.Name, pool.Exposure))
+		}
+		if pool.Exposure == ExposureIngress && c.Ingress.BaseDomain == "" {
+			errs = append(errs, fmt.Errorf("pools.%s.exposure: ingress needs ingress.baseDomain", pool.Name))
+		}
+	}
+	if c.FailedClusters.Policy != FailurePolicyKeep && c.FailedClusters.Policy != FailurePolicyDelete {
+		errs = append(errs, fmt.Errorf("failedClusters.policy must be keep or delete, got %q", c.FailedClusters.Policy))
+	}
+	if c.Ingress.ClassName == "" {
+		errs = append(errs, errors.New("ingress.className must not be empty"))
+	}
+	if c.NodePort.Address == "" && len(c.NodePort.AddressTypes) == 0 {
+		errs = append(errs, errors.New("nodePort.addressTypes must not be empty when nodePort.address is unset"))
+	}
+	for _, t := range c.NodePort.AddressTypes {
+		if !validNodeAddressTypes[t] {
+			errs = append(errs, fmt.Errorf("nodePort.addressTypes: unknown address type %q", t))
+		}
+	}
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("logging.level: unknown level %q", c.Logging.Level))
+	}
+	if c.Logging.Format != "json" && c.Logging.Format != "text" {
+		errs = append(errs, fmt.Errorf("logging.format must be json or text, got %q", c.Logging.Format))
+	}
+	if c.Audit.Log == "" {
+		errs = append(errs, errors.New("audit.log must not be empty"))
+	}
+	for _, entry := range c.Uploads.AllowedExecCommands {
+		if strings.TrimSpace(entry) == "" {
+			errs = append(errs, errors.New("uploads.allowedExecCommands: entries must not be empty"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// queuePriority returns the highest priority of the teams the user is in.
+func (c *Config) queuePriority(user string) int {
+	priority, found := 0, false
+	for _, p := range c.Queue.Priorities {
+		for _, u := range p.Users {
+			if u == user && (!found || p.Priority > priority) {
+				priority, found = p.Priority, true
+			}
+		}
+	}
+	return priority
+}
+
+// pool returns the pool with the given name.
+func (c *Config) pool(name string) (PoolConfig, bool) {
+	for _, pool := range c.Pools {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return PoolConfig{}, false
+}
+
+// isAdmin reports whether the user is one of the configured admin users.
+func (c *Config) isAdmin(user string) bool {
+	for _, admin := range c.AdminUsers {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// keepRestartOnly copies the settings that are only read at startup from prev,
+// returning the names of those the reloaded config tried to change.
+func (c *Config) keepRestartOnly(prev *Config) []string {
+	var ignored []string
+	if c.ListenAddr != prev.ListenAddr {
+		ignored = append(ignored, "listenAddr")
+		c.ListenAddr = prev.ListenAddr
+	}
+	if c.Logging.Format != prev.Logging.Format {
+		ignored = append(ignored, "logging.format")
+		c.Logging.Format = prev.Logging.Format
+	}
+	if c.Audit.Log != prev.Audit.Log {
+		ignored = append(ignored, "audit.log")
+		c.Audit.Log = prev.Audit.Log
+	}
+	if c.Downloads.SigningKey != prev.Downloads.SigningKey {
+		ignored = append(ignored, "downloads.signingKey")
+		c.Downloads.SigningKey = prev.Downloads.SigningKey
+	}
+	if c.Coordination != prev.Coordination {
+		ignored = append(ignored, "coordination")
+		c.Coordination = prev.Coordination
+	}
+	return ignored
+}
+
+// reloadConfigOnHangup reloads the configuration on SIGHUP. An invalid config
+// is rejected and the running one kept. Settings bound at startup (listen
+// address, log format, audit sink, signing key, coordination) need a restart.
+func reloadConfigOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig()
+			if err != nil {
+				rootLogger.Error("config reload failed, keeping current config", "err", err)
+				continue
+			}
+			if ignored := cfg.keepRestartOnly(currentConfig()); len(ignored) > 0 {
+				rootLogger.Warn("config reload ignores settings that need a restart", "settings", ignored)
+			}
+			activeConfig.Store(cfg)
+			logLevel.Set(parseLogLevel(cfg.Logging.Level))
+			provisioning.limitsChanged()
+			rootLogger.Info("config reloaded")
+		}
+	}()
+}
+
+// configHandler serves GET /api/config: the effective configuration without
+// secrets or host paths, plus the exposure modes that can be offered. The admin
+// users and the users of queue priorities are only shown to admins.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := currentConfig()
+	if !isAdminUser(getUserFromRequest(r)) {
+		redacted := *cfg
+		redacted.AdminUsers = nil
+		redacted.Queue.Priorities = make([]PriorityConfig, len(cfg.Queue.Priorities))
+		for i, p := range cfg.Queue.Priorities {
+			p.Users = nil
+			redacted.Queue.Priorities[i] = p
+		}
+		cfg = &redacted
+	}
+	exposures := []string{ExposureNone, ExposureLoadBalancer, ExposureNodePort}
+	if cfg.Ingress.BaseDomain != "" {
+		exposures = append(exposures, ExposureIngress)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*Config
+		Exposures []string `json:"exposures"`
+	}{cfg, exposures})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		errs   []string
+	}{
+		{"defaults", func(*Config) {}, nil},
+		{"bad listen address", func(c *Config) { c.ListenAddr = "8081" }, []string{"listenAddr"}},
+		{"one HA replica", func(c *Config) { c.HAReplicas = 1 }, []string{"haReplicas must be at least 2"}},
+		{"zero command timeout", func(c *Config) { c.Timeouts.Command.Duration = 0 }, []string{"timeouts.command must be positive"}},
+		{"unknown stage", func(c *Config) { c.Timeouts.Stages = map[string]Duration{"bake": {time.Minute}} }, []string{`unknown stage "bake"`}},
+		{"negative stage", func(c *Config) { c.Timeouts.Stages = map[string]Duration{"install": {-time.Minute}} }, []string{"timeouts.stages.install must not be negative"}},
+		{"default TTL above max", func(c *Config) { c.Credentials.DefaultTTL.Duration = 48 * time.Hour }, []string{"credentials.defaultTTL"}},
+		{"negative queue limit", func(c *Config) { c.Queue.MaxPerHost = -1 }, []string{"must not be negative"}},
+		{"coordination without namespace", func(c *Config) { c.Coordination.Enabled, c.Coordination.Namespace = true, "" }, []string{"coordination.namespace"}},
+		{"coordination without signing key", func(c *Config) { c.Coordination.Enabled = true }, []string{"downloads.signingKey must be set"}},
+		{"coordination", func(c *Config) { c.Coordination.Enabled, c.Downloads.SigningKey = true, "key" }, nil},
+		{"short lease", func(c *Config) { c.Coordination.LeaseDuration.Duration = time.Second }, []string{"coordination.leaseDuration"}},
+		{"unnamed priority", func(c *Config) { c.Queue.Priorities = []PriorityConfig{{Priority: 1}} }, []string{"queue.priorities[0]: name must not be empty"}},
+		{"duplicate pool", func(c *Config) { c.Pools = []PoolConfig{{Name: "ci"}, {Name: "ci"}} }, []string{`duplicate name "ci"`}},
+		{"pool name with dot", func(c *Config) { c.Pools = []PoolConfig{{Name: "c.i"}} }, []string{"must be a DNS label"}},
+		{"ingress pool without domain", func(c *Config) { c.Pools = []PoolConfig{{Name: "ci", Exposure: ExposureIngress}} }, []string{"ingress needs ingress.baseDomain"}},
+		{"unknown policy", func(c *Config) { c.FailedClusters.Policy = "retry" }, []string{"failedClusters.policy"}},
+		{"unknown address type", func(c *Config) { c.NodePort.AddressTypes = []string{"PublicIP"} }, []string{`unknown address type "PublicIP"`}},
+		{"no address types", func(c *Config) { c.NodePort.AddressTypes = nil }, []string{"nodePort.addressTypes must not be empty"}},
+		{"address without types", func(c *Config) { c.NodePort.Address, c.NodePort.AddressTypes = "10.0.0.1", nil }, nil},
+		{"unknown log level", func(c *Config) { c.Logging.Level = "trace" }, []string{"logging.level"}},
+		{"blank exec entry", func(c *Config) { c.Uploads.AllowedExecCommands = []string{" "} }, []string{"uploads.allowedExecCommands"}},
+		{"several errors", func(c *Config) { c.CORSOrigin, c.Audit.Log = "", "" }, []string{"corsOrigin", "audit.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(cfg)
+			err := cfg.validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validate() = nil, want errors containing %q", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validate() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepRestartOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		ignored []string
+	}{
+		{"nothing changed", func(*Config) {}, nil},
+		{"reloadable settings", func(c *Config) {
+			c.AdminUsers = []string{"root"}
+			c.Logging.Level = "debug"
+			c.Queue.MaxConcurrent = 8
+		}, nil},
+		{"listen address", func(c *Config) { c.ListenAddr = ":9090" }, []string{"listenAddr"}},
+		{"log format", func(c *Config) { c.Logging.Format = "text" }, []string{"logging.format"}},
+		{"signing key and coordination", func(c *Config) {
+			c.Downloads.SigningKey = "new"
+			c.Coordination.Enabled = true
+		}, []string{"downloads.signingKey", "coordination"}},
+		{"audit sink", func(c *Config) { c.Audit.Log = "/var/log/audit.log" }, []string{"audit.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := defaultConfig()
+			cfg := defaultConfig()
+			tt.modify(cfg)
+			want := defaultConfig()
+			tt.modify(want)
+			ignored := cfg.keepRestartOnly(prev)
+			if !reflect.DeepEqual(ignored, tt.ignored) {
+				t.Errorf("keepRestartOnly() = %q, want %q", ignored, tt.ignored)
+			}
+			want.ListenAddr = prev.ListenAddr
+			want.Logging.Format = prev.Logging.Format
+			want.Audit.Log = prev.Audit.Log
+			want.Downloads = prev.Downloads
+			want.Coordination = prev.Coordination
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("keepRestartOnly() left %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
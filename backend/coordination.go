@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With coordination enabled, several replicas share the default host:
+//   - the replica holding the kubehatch-leader Lease runs the background
+//     loops: the failed-cluster reaper, the pool refiller, the reconciler
+//     that resumes operations of replicas that are gone and the dispatcher of
+//     the provisioning queue
+//   - every replica renews a kubehatch-replica-<id> Lease as a heartbeat, so
+//     its operations can be told apart from orphaned ones
+//   - an operation that changes a cluster holds the kubehatch-cluster-<name>
+//     Lease until it ends
+//
+// Without coordination, the only replica is the leader, and cluster locks and
+// idempotency keys stay in memory.
+
+// Names of the Leases in coordination.namespace.
+const (
+	leaderLease        = "kubehatch-leader"
+	replicaLeasePrefix = "kubehatch-replica-"
+	clusterLeasePrefix = "kubehatch-cluster-"
+)
+
+// labelReplicaLease marks the heartbeat Leases.
+const labelReplicaLease = "kubehatch.io/replica"
+
+// reconcileInterval is how often the leader looks for orphaned operations.
+const reconcileInterval = 30 * time.Second
+
+// microTime is the format of Lease timestamps.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// errLeaseHeld is returned when someone else holds a Lease.
+var errLeaseHeld = errors.New("lease is held by another replica")
+
+// errClusterBusy is returned when another operation holds a cluster's lock.
+var errClusterBusy = errors.New("another operation on the cluster is in progress")
+
+// errLockLost is the cancel cause of an operation whose cluster lock could
+// not be renewed for longer than the lease duration.
+var errLockLost = errors.New("stopped after losing the cluster lock")
+
+// replicaID names this process in Leases and operation records. A restarted
+// pod gets a new one, so its old operations count as orphaned.
+var replicaID = newReplicaID()
+
+// leading reports whether this replica runs the background loops.
+var leading atomic.Bool
+
+func newReplicaID() string {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if name == "" {
+		name = "kubehatch"
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return strings.ToLower(name) + "-" + hex.EncodeToString(suffix)
+}
+
+// LeaseJSON is the part of a coordination.k8s.io Lease that is used here.
+type LeaseJSON struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// expired reports whether the holder has not renewed the Lease in time.
+func (l LeaseJSON) expired(now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if l.Spec.HolderIdentity == "" || err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// coordinationKubectl runs kubectl in coordination.namespace on the default
+// host, with stdin if given.
+func coordinationKubectl(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	args = append([]string{"-n", currentConfig().Coordination.Namespace}, args...)
+	if hostKubeconfig := getDefaultKubeconfig(); hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return runCommand(ctx, cmd)
+}
+
+// acquireLease takes or renews the named Lease for holder. It returns
+// errLeaseHeld if someone else holds it and has renewed it in time.
+func acquireLease(ctx context.Context, name, holder string, duration time.Duration, labels map[string]string) error {
+	now := time.Now().UTC()
+	var lease LeaseJSON
+	verb := "replace"
+	out, err := coordinationKubectl(ctx, nil, "get", "lease", name, "-o", "json")
+	switch {
+	case err != nil && strings.Contains(string(out), "NotFound"):
+		verb = "create"
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Labels = name, labels
+	case err != nil:
+		return fmt.Errorf("getting lease %s: %v, output: %s", name, err, string(out))
+	default:
+		if err := json.Unmarshal(out, &lease); err != nil {
+			return fmt.Errorf("parsing lease %s: %v", name, err)
+		}
+		if lease.Spec.HolderIdentity != holder && !lease.expired(now) {
+			return errLeaseHeld
+		}
+	}
+	if lease.Spec.HolderIdentity != holder {
+		if lease.Spec.HolderIdentity != "" {
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = holder
+		lease.Spec.AcquireTime = now.Format(microTime)
+	}
+	lease.Spec.RenewTime = now.Format(microTime)
+	lease.Spec.LeaseDurationSeconds = int(duration.Seconds())
+	manifest, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	// replace carries the resourceVersion that was read, so a concurrent
+	// update makes it fail with a conflict.
+	if out, err := coordinationKubectl(ctx, manifest, verb, "-f", "-"); err != nil {
+		if strings.Contains(string(out), "AlreadyExists") || strings.Contains(string(out), "Conflict") ||
+			strings.Contains(string(out), "the object has been modified") {
+			return errLeaseHeld
+		}
+		return fmt.Errorf("%s lease %s: %v, output: %s", verb, name, err, string(out))
+	}
+	return nil
+}
+
+// releaseLease deletes the named Lease if holder still holds it.
+func releaseLease(ctx context.Context, name, holder string) error {
+	out, err := coordinationKubectl(ctx, nil, "get", "lease", name, "-o", "json")
+	if err != nil {
+		if strings.Contains(string(out), "NotFound") {
+			return nil
+		}
+		return fmt.Errorf("getting lease %s: %v, output: %s", name, err, string(out))
+	}
+	var lease LeaseJSON
+	if err := json.Unmarshal(out, &lease); err != nil {
+		return fmt.Errorf("parsing lease %s: %v", name, err)
+	}
+	if lease.Spec.HolderIdentity != holder {
+		return nil
+	}
+	if out, err := coordinationKubectl(ctx, nil, "delete", "lease", name, "--ignore-not-found"); err != nil {
+		return fmt.Errorf("deleting lease %s: %v, output: %s", name, err, string(out))
+	}
+	return nil
+}
+
+// backgroundCtx ends the background loops on shutdown; backgroundLoops
+// counts the loops that hold Leases.
+var (
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+	backgroundLoops               sync.WaitGroup
+)
+
+// runBackgroundLoops starts the reaper, the pool refiller and the recovery of
+// unfinished operations: right away without coordination, else while this
+// replica is the leader.
+func runBackgroundLoops() {
+	if !currentConfig().Coordination.Enabled {
+		leading.Store(true)
+		ctx := backgroundCtx
+		go reapFailedClusters(ctx)
+		go refillPools(ctx)
+		go recoverOperations(ctx, nil)
+		return
+	}
+	backgroundLoops.Add(2)
+	go heartbeat(backgroundCtx)
+	go electLeader(backgroundCtx)
+	go watchCancelRequests()
+}
+
+// heartbeat renews this replica's Lease until ctx ends.
+func heartbeat(ctx context.Context) {
+	defer backgroundLoops.Done()
+	duration := currentConfig().Coordination.LeaseDuration.Duration
+	labels := map[string]string{labelReplicaLease: "true"}
+	for {
+		renewCtx, cancel := context.WithTimeout(ctx, duration/3)
+		if err := acquireLease(renewCtx, replicaLeasePrefix+replicaID, replicaID, duration, labels); err != nil && ctx.Err() == nil {
+			logger(ctx).Warn("renewing replica lease failed", "replica", replicaID, "err", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(duration / 3):
+		}
+	}
+}
+
+// electLeader tries to take or renew the leader Lease every third of its
+// duration, until ctx ends. The leader steps down if it could not renew for
+// two thirds of it, before another replica may take over.
+func electLeader(ctx context.Context) {
+	defer backgroundLoops.Done()
+	duration := currentConfig().Coordination.LeaseDuration.Duration
+	interval := duration / 3
+	var stop context.CancelFunc
+	var renewed time.Time
+	defer func() {
+		if stop != nil {
+			leading.Store(false)
+			stop()
+		}
+	}()
+	for {
+		electCtx, cancel := context.WithTimeout(ctx, interval)
+		err := acquireLease(electCtx, leaderLease, replicaID, duration, nil)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			renewed = time.Now()
+			if stop == nil {
+				logger(ctx).Info("became leader", "replica", replicaID)
+				stop = lead(ctx)
+			}
+		case stop != nil && (errors.Is(err, errLeaseHeld) || time.Since(renewed) > 2*interval):
+			logger(ctx).Warn("stepping down as leader", "replica", replicaID, "err", err)
+			leading.Store(false)
+			stop()
+			stop = nil
+		case !errors.Is(err, errLeaseHeld):
+			logger(ctx).Warn("leader election failed", "replica", replicaID, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lead runs the loops of the leader until the returned function is called.
+func lead(ctx context.Context) context.CancelFunc {
+	ctx, stop := context.WithCancel(ctx)
+	leading.Store(true)
+	go reapFailedClusters(ctx)
+	go refillPools(ctx)
+	go reconcileOperations(ctx)
+	go dispatchSharedQueue(ctx)
+	return stop
+}
+
+// releaseReplicaLeases stops the heartbeat and the leader election and gives
+// up the leader and heartbeat Leases, so that another replica takes over at
+// once.
+func releaseReplicaLeases(ctx context.Context) {
+	stopBackground()
+	if !currentConfig().Coordination.Enabled {
+		return
+	}
+	backgroundLoops.Wait()
+	for _, name := range []string{leaderLease, replicaLeasePrefix + replicaID} {
+		if err := releaseLease(ctx, name, replicaID); err != nil {
+			logger(ctx).Warn("releasing lease failed", "lease", name, "err", err)
+		}
+	}
+}
+
+// liveReplicas returns the replicas whose heartbeat Lease is current, and
+// deletes those that expired long ago.
+func liveReplicas(ctx context.Context) (map[string]bool, error) {
+	out, err := coordinationKubectl(ctx, nil, "get", "leases", "-l", labelReplicaLease+"=true", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("listing replica leases: %v, output: %s", err, string(out))
+	}
+	var list struct {
+		Items []LeaseJSON `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parsing replica leases: %v", err)
+	}
+	now := time.Now()
+	alive := map[string]bool{replicaID: true}
+	for _, lease := range list.Items {
+		switch {
+		case !lease.expired(now):
+			alive[lease.Spec.HolderIdentity] = true
+		case lease.expired(now.Add(-time.Hour)):
+			if out, err := coordinationKubectl(ctx, nil, "delete", "lease", lease.Metadata.Name, "--ignore-not-found"); err != nil {
+				logger(ctx).Debug("deleting stale replica lease failed", "lease", lease.Metadata.Name, "err", err, "output", string(out))
+			}
+		}
+	}
+	return alive, nil
+}
+
+// replicasAlive returns the live replicas, or nil without coordination, when
+// this is the only one.
+func replicasAlive(ctx context.Context) (map[string]bool, error) {
+	if !currentConfig().Coordination.Enabled {
+		return nil, nil
+	}
+	return liveReplicas(ctx)
+}
+
+// reconcileOperations resumes the operations of replicas that are gone and
+// expires idempotency keys and downloads, for as long as ctx lasts.
+func reconcileOperations(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		alive, err := liveReplicas(ctx)
+		if err != nil {
+			logger(ctx).Warn("listing live replicas failed", "err", err)
+		} else {
+			recoverOperations(ctx, alive)
+		}
+		expireIdempotencyKeys(ctx)
+		expireDownloads(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var (
+	clusterLocksMu sync.Mutex
+	clusterLocks   = map[string]string{}
+)
+
+// lockCluster takes the lock on a cluster for holder until the returned
+// function is called. It returns errClusterBusy if the lock is taken. With
+// coordination, the lock is a Lease that is renewed in the background; if
+// renewing fails for longer than the lease duration, another replica may have
+// taken it, so renewing stops and lost is called.
+func lockCluster(ctx context.Context, clusterName, holder string, lost func()) (func(), error) {
+	clusterLocksMu.Lock()
+	if _, held := clusterLocks[clusterName]; held {
+		clusterLocksMu.Unlock()
+		return nil, errClusterBusy
+	}
+	clusterLocks[clusterName] = holder
+	clusterLocksMu.Unlock()
+	unlockLocal := func() {
+		clusterLocksMu.Lock()
+		delete(clusterLocks, clusterName)
+		clusterLocksMu.Unlock()
+	}
+	cfg := currentConfig().Coordination
+	if !cfg.Enabled {
+		return unlockLocal, nil
+	}
+
+	name := clusterLeasePrefix + clusterName
+	duration := cfg.LeaseDuration.Duration
+	if err := acquireLease(ctx, name, holder, duration, nil); err != nil {
+		unlockLocal()
+		if errors.Is(err, errLeaseHeld) {
+			return nil, errClusterBusy
+		}
+		return nil, err
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(duration / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), duration/3)
+			err := acquireLease(renewCtx, name, holder, duration, nil)
+			cancel()
+			switch {
+			case err == nil:
+				renewed = time.Now()
+			case errors.Is(err, errLeaseHeld) || time.Since(renewed) > duration:
+				logger(ctx).Error("lost cluster lock", "cluster", clusterName, "err", err)
+				lost()
+				return
+			default:
+				logger(ctx).Warn("renewing cluster lock failed", "cluster", clusterName, "err", err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), duration)
+			defer cancel()
+			if err := releaseLease(releaseCtx, name, holder); err != nil {
+				logger(ctx).Warn("releasing cluster lock failed", "cluster", clusterName, "err", err)
+			}
+			unlockLocal()
+		})
+	}, nil
+}
+
+// lockCluster takes the cluster's lock for the rest of the operation. If it
+// cannot, it writes the error response, 409 if another operation holds the
+// lock, and returns false. The operation is cancelled with errLockLost if the
+// lock is lost.
+func (op *operation) lockCluster(w http.ResponseWriter, ctx context.Context) bool {
+	unlock, err := lockCluster(ctx, op.cluster, replicaID+"/"+op.id, func() { op.cancel(errLockLost) })
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errClusterBusy) {
+			status = http.StatusConflict
+		}
+		op.fail(w, fmt.Sprintf("Error locking cluster %s: %v", op.cluster, err), status)
+		return false
+	}
+	op.unlock = unlock
+	return true
+}
+
+// leaderGauge reports whether this replica is the leader.
+type leaderGauge struct{}
+
+func (leaderGauge) writeTo(w io.Writer) {
+	value := 0
+	if leading.Load() {
+		value = 1
+	}
+	fmt.Fprintf(w, "# HELP kubehatch_leader Whether this replica runs the background loops.\n# TYPE kubehatch_leader gauge\nkubehatch_leader %d\n", value)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Roles a caller can request for a minted kubeconfig, lowest first.
+const (
+	RoleView  = "view"
+	RoleEdit  = "edit"
+	RoleAdmin = "admin"
+)
+
+const (
+	// credentialNamespace holds the ServiceAccounts inside each virtual cluster.
+	credentialNamespace = "kubehatch-system"
+)
+
+var roleRank = map[string]int{RoleView: 1, RoleEdit: 2, RoleAdmin: 3}
+
+// roleClusterRoles maps a KubeHatch role to the built-in ClusterRole bound
+// inside the virtual cluster.
+var roleClusterRoles = map[string]string{
+	RoleView:  "view",
+	RoleEdit:  "edit",
+	RoleAdmin: "cluster-admin",
+}
+
+// Credential describes a kubeconfig minted for a user. It is backed by a
+// ServiceAccount inside the virtual cluster; deleting that account revokes
+// every token issued for it.
+type Credential struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Role      string    `json:"role"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ServiceAccountJSON is used to parse the credential ServiceAccounts.
+type ServiceAccountJSON struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// maxRoleFor returns the highest role the user may request for a cluster.
+// Admins and owners get full access, legacy clusters without an owner can
+// be edited by anyone, everyone else may only view.
+func maxRoleFor(currentUser, owner string) string {
+	switch {
+	case isAdminUser(currentUser) || currentUser == owner:
+		return RoleAdmin
+	case owner == "":
+		return RoleEdit
+	default:
+		return RoleView
+	}
+}
+
+// canManageCredentials reports whether the user may list and revoke other
+// users' credentials for the cluster.
+func canManageCredentials(currentUser, owner string) bool {
+	return maxRoleFor(currentUser, owner) == RoleAdmin
+}
+
+// parseCredentialRequest reads the role and ttl query parameters and checks
+// them against the caller's permission level.
+func parseCredentialRequest(r *http.Request, currentUser, owner string) (string, time.Duration, error) {
+	maxRole := maxRoleFor(currentUser, owner)
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = maxRole
+	}
+	if _, ok := roleRank[role]; !ok {
+		return "", 0, fmt.Errorf("unknown role %q, expected admin, edit or view", role)
+	}
+	if roleRank[role] > roleRank[maxRole] {
+		return "", 0, fmt.Errorf("user %s may request at most the %s role", currentUser, maxRole)
+	}
+
+	limits := currentConfig().Credentials
+	ttl := limits.DefaultTTL.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid ttl %q: %v", raw, err)
+		}
+		ttl = d
+	}
+	if ttl < limits.MinTTL.Duration {
+		ttl = limits.MinTTL.Duration
+	}
+	if ttl > limits.MaxTTL.Duration {
+		ttl = limits.MaxTTL.Duration
+	}
+	return role, ttl, nil
+}
+
+// getBackendKubeconfig returns the vcluster admin kubeconfig from the
+// vc-<name> secret, pointed at an address the backend itself can reach: the
+// external endpoint when one is known, the in-cluster service otherwise.
+func getBackendKubeconfig(ctx context.Context, hostKubeconfig, clusterName, externalEndpoint string) ([]byte, error) {
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "secret", "vc-" + clusterName, "-n", namespace, "--template={{.data.config}}"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig secret not found: %v", err)
+	}
+	kcData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil || len(kcData) == 0 {
+		return nil, fmt.Errorf("kubeconfig secret is empty or invalid")
+	}
+
+	endpoint := externalEndpoint
+	if endpoint == "" {
+		endpoint, err = getClusterIPEndpoint(ctx, hostKubeconfig, clusterName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return updateKubeconfigEndpoint(kcData, endpoint)
+}
+
+// runVirtualKubectl runs kubectl against a virtual cluster using the given
+// kubeconfig, which is written to a temporary file for the duration of the call.
+func runVirtualKubectl(ctx context.Context, kcData, stdin []byte, args ...string) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "vkubeconfig-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(kcData); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	tmp.Close()
+
+	cmd := exec.Command("kubectl", append([]string{"--kubeconfig", tmp.Name()}, args...)...)
+	cmd.Env = filterEnv(os.Environ(), []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT", "KUBERNETES_PORT", "KUBECONFIG"})
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return runCommand(ctx, cmd)
+}
+
+func newCredentialID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issueCredential creates a ServiceAccount bound to the role inside the virtual
+// cluster, requests a token for it with the given lifetime and returns a
+// kubeconfig that uses it. adminKC is the kubeconfig handed to users so far;
+// its cluster entries (server and CA) are kept and its users are replaced.
+func issueCredential(ctx context.Context, hostKubeconfig, clusterName string, adminKC []byte, user, role string, ttl time.Duration) (Credential, []byte, error) {
+	backendKC, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, "")
+	if err != nil {
+		return Credential{}, nil, err
+	}
+
+	// Expired credentials no longer authenticate; drop their accounts.
+	if creds, err := listCredentials(ctx, backendKC); err == nil {
+		for _, c := range creds {
+			if time.Now().After(c.ExpiresAt) {
+				revokeCredential(ctx, backendKC, c.ID)
+			}
+		}
+	}
+
+	id, err := newCredentialID()
+	if err != nil {
+		return Credential{}, nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	cred := Credential{ID: id, User: user, Role: role, IssuedAt: now, ExpiresAt: now.Add(ttl)}
+	name := "kubehatch-" + id
+	if err := applyCredentialAccount(ctx, backendKC, name, cred); err != nil {
+		return Credential{}, nil, err
+	}
+
+	out, err := runVirtualKubectl(ctx, backendKC, nil, "create", "token", name, "-n", credentialNamespace,
+		fmt.Sprintf("--duration=%ds", int(ttl.Seconds())))
+	if err != nil {
+		revokeCredential(ctx, backendKC, id)
+		return Credential{}, nil, fmt.Errorf("failed to create token: %v, output: %s", err, string(out))
+	}
+	token := strings.TrimSpace(string(out))
+
+	kcData, err := kubeconfigWithToken(adminKC, clusterName+"-"+role, token)
+	if err != nil {
+		revokeCredential(ctx, backendKC, id)
+		return Credential{}, nil, err
+	}
+	logger(ctx).Info("issued credential", "cluster", clusterName, "credential", id, "user", user, "role", role, "expires", cred.ExpiresAt)
+	return cred, kcData, nil
+}
+
+// execCredentialID returns the ID of the credential that backs every token the
+// exec plugin fetches for a user and role.
+func execCredentialID(user, role string) string {
+	sum := sha256.Sum256([]byte(user))
+	return "exec-" + hex.EncodeToString(sum[:6]) + "-" + role
+}
+
+// issueExecToken requests a token for the user's exec credential of the role,
+// creating its ServiceAccount and binding on first use. The same account is
+// reused for every token, and its expiry follows the newest token, so it is
+// pruned like any other credential once that has expired.
+func issueExecToken(ctx context.Context, hostKubeconfig, clusterName, user, role string, ttl time.Duration) (string, time.Time, error) {
+	backendKC, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, "")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	id := execCredentialID(user, role)
+	name := "kubehatch-" + id
+	now := time.Now().UTC().Truncate(time.Second)
+	cred := Credential{ID: id, User: user, Role: role, IssuedAt: now, ExpiresAt: now.Add(ttl)}
+	createToken := func() ([]byte, error) {
+		return runVirtualKubectl(ctx, backendKC, nil, "create", "token", name, "-n", credentialNamespace,
+			fmt.Sprintf("--duration=%ds", int(ttl.Seconds())))
+	}
+
+	out, err := createToken()
+	if err != nil && strings.Contains(string(out), "NotFound") {
+		if err := applyCredentialAccount(ctx, backendKC, name, cred); err != nil {
+			return "", time.Time{}, err
+		}
+		logger(ctx).Info("created exec credential", "cluster", clusterName, "credential", id, "user", user, "role", role)
+		out, err = createToken()
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create token: %v, output: %s", err, string(out))
+	}
+	if out, err := runVirtualKubectl(ctx, backendKC, nil, "annotate", "serviceaccount", name, "-n", credentialNamespace,
+		"--overwrite", "kubehatch.io/expires-at="+cred.ExpiresAt.Format(time.RFC3339)); err != nil {
+		logger(ctx).Warn("recording exec credential expiry failed", "cluster", clusterName, "credential", id, "err", err, "output", string(out))
+	}
+	return strings.TrimSpace(string(out)), cred.ExpiresAt, nil
+}
+
+// applyCredentialAccount creates or updates the ServiceAccount of a credential
+// and binds it to the credential's role.
+func applyCredentialAccount(ctx context.Context, backendKC []byte, name string, cred Credential) error {
+	labels := map[string]string{
+		"app.kubernetes.io/managed-by": "kubehatch",
+		"kubehatch.io/credential":      cred.ID,
+	}
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items": []interface{}{
+			map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata":   map[string]interface{}{"name": credentialNamespace},
+			},
+			map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ServiceAccount",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": credentialNamespace,
+					"labels":    labels,
+					"annotations": map[string]string{
+						"kubehatch.io/user":       cred.User,
+						"kubehatch.io/role":       cred.Role,
+						"kubehatch.io/issued-at":  cred.IssuedAt.Format(time.RFC3339),
+						"kubehatch.io/expires-at": cred.ExpiresAt.Format(time.RFC3339),
+					},
+				},
+			},
+			map[string]interface{}{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       "ClusterRoleBinding",
+				"metadata":   map[string]interface{}{"name": name, "labels": labels},
+				"roleRef": map[string]interface{}{
+					"apiGroup": "rbac.authorization.k8s.io",
+					"kind":     "ClusterRole",
+					"name":     roleClusterRoles[cred.Role],
+				},
+				"subjects": []interface{}{
+					map[string]interface{}{"kind": "ServiceAccount", "name": name, "namespace": credentialNamespace},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if out, err := runVirtualKubectl(ctx, backendKC, data, "apply", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to create service account: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// kubeconfigWithToken replaces the users of a kubeconfig with a single
+// token-based user and points every context at it.
+func kubeconfigWithToken(kcData []byte, userName, token string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(kcData, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconfig: %v", err)
+	}
+	config["users"] = []interface{}{
+		map[string]interface{}{
+			"name": userName,
+			"user": map[string]interface{}{"token": token},
+		},
+	}
+	setContextUser(config, userName)
+	updated, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal kubeconfig: %v", err)
+	}
+	return updated, nil
+}
+
+// listCredentials returns the credentials issued for a virtual cluster.
+func listCredentials(ctx context.Context, backendKC []byte) ([]Credential, error) {
+	out, err := runVirtualKubectl(ctx, backendKC, nil, "get", "serviceaccounts", "-n", credentialNamespace,
+		"-l", "app.kubernetes.io/managed-by=kubehatch", "-o", "json", "--ignore-not-found")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service accounts: %v, output: %s", err, string(out))
+	}
+	creds := []Credential{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return creds, nil
+	}
+	var list struct {
+		Items []ServiceAccountJSON `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse service accounts: %v", err)
+	}
+	for _, sa := range list.Items {
+		c := Credential{
+			ID:   sa.Metadata.Labels["kubehatch.io/credential"],
+			User: sa.Metadata.Annotations["kubehatch.io/user"],
+			Role: sa.Metadata.Annotations["kubehatch.io/role"],
+		}
+		c.IssuedAt, _ = time.Parse(time.RFC3339, sa.Metadata.Annotations["kubehatch.io/issued-at"])
+		c.ExpiresAt, _ = time.Parse(time.RFC3339, sa.Metadata.Annotations["kubehatch.io/expires-at"])
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+// revokeCredential deletes the ServiceAccount and binding of a credential,
+// which invalidates all tokens issued for it.
+func revokeCredential(ctx context.Context, backendKC []byte, id string) error {
+	selector := "kubehatch.io/credential=" + id
+	out, err := runVirtualKubectl(ctx, backendKC, nil, "delete", "serviceaccount,clusterrolebinding", "-A", "-l", selector, "--ignore-not-found")
+	if err != nil {
+		return fmt.Errorf("failed to revoke credential %s: %v, output: %s", id, err, string(out))
+	}
+	return nil
+}
+
+// credentialsHandler lists and revokes issued credentials:
+//
+//	GET    /api/vcluster/{name}/credentials       list credentials
+//	DELETE /api/vcluster/{name}/credentials       revoke all visible credentials
+//	DELETE /api/vcluster/{name}/credentials/{id}  revoke one credential
+//
+// Owners and admins see every credential; other users only their own.
+func credentialsHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig, id string) {
+	ctx := r.Context()
+	auditParams := map[string]interface{}{}
+	if r.Method == http.MethodDelete {
+		var done func()
+		w, done = auditAction(w, r, AuditCredentialRevoke, clusterName, auditParams)
+		defer done()
+		if id != "" {
+			auditParams["id"] = id
+		}
+	}
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
+	manage := canManageCredentials(currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName))
+
+	backendKC, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reaching cluster: %v", err), http.StatusBadGateway)
+		return
+	}
+	creds, err := listCredentials(ctx, backendKC)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing credentials: %v", err), http.StatusBadGateway)
+		return
+	}
+	visible := []Credential{}
+	for _, c := range creds {
+		if manage || c.User == currentUser {
+			visible = append(visible, c)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(visible)
+	case http.MethodDelete:
+		revoked := []string{}
+		for _, c := range visible {
+			if id != "" && c.ID != id {
+				continue
+			}
+			if err := revokeCredential(ctx, backendKC, c.ID); err != nil {
+				auditParams["revoked"] = revoked
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			logger(ctx).Info("revoked credential", "cluster", clusterName, "credential", c.ID, "credential_user", c.User, "user", currentUser)
+			revoked = append(revoked, c.ID)
+		}
+		auditParams["revoked"] = revoked
+		if id != "" && len(revoked) == 0 {
+			http.Error(w, "Credential not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"revoked": revoked})
+	default:
+		http.Error(w, "Only GET and DELETE allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestMaxRoleFor(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminUsers = []string{"root"}
+	useConfig(t, cfg)
+
+	tests := []struct {
+		user, owner, want string
+	}{
+		{"root", "alice", RoleAdmin},
+		{"default", "alice", RoleAdmin},
+		{"alice", "alice", RoleAdmin},
+		{"bob", "", RoleEdit},
+		{"bob", "alice", RoleView},
+	}
+	for _, tt := range tests {
+		if got := maxRoleFor(tt.user, tt.owner); got != tt.want {
+			t.Errorf("maxRoleFor(%q, %q) = %q, want %q", tt.user, tt.owner, got, tt.want)
+		}
+	}
+}
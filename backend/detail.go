@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// maxDetailEvents caps the number of host events returned in the detail view.
+const maxDetailEvents = 50
+
+// VclusterDetail is the full per-cluster view returned by GET /api/vcluster/{name}.
+type VclusterDetail struct {
+	VclusterInfo
+	Parameters  *ClusterParams    `json:"parameters,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Service     *ServiceDetail    `json:"service,omitempty"`
+	Pods        []PodDetail       `json:"pods"`
+	Volumes     []VolumeDetail    `json:"volumes"`
+	Events      []EventDetail     `json:"events"`
+}
+
+// ServiceDetail describes the host service that fronts the virtual API server.
+type ServiceDetail struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	ClusterIP string `json:"clusterIP,omitempty"`
+	Ports     []int  `json:"ports,omitempty"`
+	External  string `json:"external,omitempty"`
+}
+
+// PodDetail describes a control-plane pod and its containers.
+type PodDetail struct {
+	Name       string            `json:"name"`
+	Phase      string            `json:"phase"`
+	Node       string            `json:"node,omitempty"`
+	Restarts   int               `json:"restarts"`
+	CPU        string            `json:"cpu,omitempty"`
+	Memory     string            `json:"memory,omitempty"`
+	Containers []ContainerDetail `json:"containers"`
+}
+
+// ContainerDetail describes a single container of a control-plane pod.
+type ContainerDetail struct {
+	Name     string `json:"name"`
+	Ready    bool   `json:"ready"`
+	Restarts int    `json:"restarts"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VolumeDetail describes a persistent volume claim in the vcluster namespace.
+type VolumeDetail struct {
+	Name         string `json:"name"`
+	Phase        string `json:"phase"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Requested    string `json:"requested,omitempty"`
+	Capacity     string `json:"capacity,omitempty"`
+}
+
+// EventDetail is a host event in the vcluster namespace.
+type EventDetail struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Object  string `json:"object"`
+	Message string `json:"message"`
+	Count   int    `json:"count,omitempty"`
+	Time    string `json:"time,omitempty"`
+}
+
+// getVclusterDetailHandler returns everything needed to debug a cluster
+// without kubectl access to the host.
+func getVclusterDetailHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+	ctx := r.Context()
+	currentUser := getUserFromRequest(r)
+
+	ns, err := getClusterNamespace(ctx, hostKubeconfig, clusterName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cluster %s not found", clusterName), http.StatusNotFound)
+		return
+	}
+	owner := ns.Metadata.Annotations["kubehatch.io/owner"]
+	if !canAccessCluster(currentUser, owner) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	res, resErr := getClusterResources(ctx, hostKubeconfig, clusterName)
+	info := clusterInfo(ctx, hostKubeconfig, ns, res, resErr, true)
+	detail := buildVclusterDetail(info, ns, res, getPodUsage(ctx, hostKubeconfig, clusterName))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// buildVclusterDetail adds the namespace annotations and the resources
+// already fetched for info to the detail view.
+func buildVclusterDetail(info VclusterInfo, ns NamespaceJSON, res clusterResources, usage map[string][2]string) VclusterDetail {
+	detail := VclusterDetail{
+		VclusterInfo: info,
+		Annotations:  map[string]string{},
+		Pods:         []PodDetail{},
+		Volumes:      []VolumeDetail{},
+		Events:       []EventDetail{},
+	}
+	for k, v := range ns.Metadata.Annotations {
+		if strings.HasPrefix(k, "kubehatch.io/") {
+			detail.Annotations[k] = v
+		}
+	}
+	if raw := ns.Metadata.Annotations["kubehatch.io/params"]; raw != "" {
+		var params ClusterParams
+		if err := json.Unmarshal([]byte(raw), &params); err == nil {
+			detail.Parameters = &params
+		}
+	}
+
+	if res.svc != nil {
+		detail.Service = &ServiceDetail{
+			Name:      info.Name,
+			Type:      res.svc.Spec.Type,
+			ClusterIP: res.svc.Spec.ClusterIP,
+			External:  info.Endpoint,
+		}
+		for _, p := range res.svc.Spec.Ports {
+			detail.Service.Ports = append(detail.Service.Ports, p.Port)
+		}
+	}
+
+	for _, pod := range res.pods {
+		pd := PodDetail{
+			Name:       pod.Metadata.Name,
+			Phase:      pod.Status.Phase,
+			Node:       pod.Spec.NodeName,
+			Containers: []ContainerDetail{},
+		}
+		if u, ok := usage[pod.Metadata.Name]; ok {
+			pd.CPU, pd.Memory = u[0], u[1]
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			cd := ContainerDetail{Name: cs.Name, Ready: cs.Ready, Restarts: cs.RestartCount}
+			switch {
+			case cs.State.Waiting != nil:
+				cd.State, cd.Reason = "Waiting", cs.State.Waiting.Reason
+			case cs.State.Terminated != nil:
+				cd.State, cd.Reason = "Terminated", cs.State.Terminated.Reason
+			default:
+				cd.State = "Running"
+			}
+			pd.Restarts += cs.RestartCount
+			pd.Containers = append(pd.Containers, cd)
+		}
+		detail.Pods = append(detail.Pods, pd)
+	}
+
+	for _, pvc := range res.pvcs {
+		detail.Volumes = append(detail.Volumes, VolumeDetail{
+			Name:         pvc.Metadata.Name,
+			Phase:        pvc.Status.Phase,
+			StorageClass: pvc.Spec.StorageClassName,
+			Requested:    pvc.Spec.Resources.Requests["storage"],
+			Capacity:     pvc.Status.Capacity["storage"],
+		})
+	}
+
+	for i, e := range res.events {
+		if i == maxDetailEvents {
+			break
+		}
+		ed := EventDetail{
+			Type:    e.Type,
+			Reason:  e.Reason,
+			Object:  e.InvolvedObject.Kind + "/" + e.InvolvedObject.Name,
+			Message: e.Message,
+			Count:   e.Count,
+		}
+		if t := e.When(); !t.IsZero() {
+			ed.Time = t.Format(time.RFC3339)
+		}
+		detail.Events = append(detail.Events, ed)
+	}
+	return detail
+}
+
+// getClusterNamespace returns the host namespace of a vcluster.
+func getClusterNamespace(ctx context.Context, hostKubeconfig, clusterName string) (NamespaceJSON, error) {
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "namespace", namespace, "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		return NamespaceJSON{}, fmt.Errorf("failed to get namespace %s: %v, output: %s", namespace, err, string(out))
+	}
+	var ns NamespaceJSON
+	if err := json.Unmarshal(out, &ns); err != nil {
+		return NamespaceJSON{}, fmt.Errorf("failed to parse namespace: %v", err)
+	}
+	return ns, nil
+}
+
+// getPodUsage returns CPU and memory usage per pod from metrics-server. It
+// returns an empty map when metrics are not available on the host.
+func getPodUsage(ctx context.Context, hostKubeconfig, clusterName string) map[string][2]string {
+	usage := map[string][2]string{}
+	namespace := "vcluster-" + clusterName
+	args := []string{"top", "pod", "-n", namespace, "-l", "app=vcluster,release=" + clusterName, "--no-headers"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	out, err := runCommandOutput(ctx, cmd)
+	if err != nil {
+		return usage
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 {
+			usage[fields[0]] = [2]string{fields[1], fields[2]}
+		}
+	}
+	return usage
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildVclusterDetail(t *testing.T) {
+	var res clusterResources
+	res.svc = &ServiceJSON{}
+	res.svc.Spec.Type = "ClusterIP"
+	var pod PodJSON
+	if err := json.Unmarshal([]byte(`{"metadata":{"name":"demo-0"},"status":{"phase":"Running","containerStatuses":[
+		{"name":"syncer","ready":false,"restartCount":2,"state":{"waiting":{"reason":"CrashLoopBackOff"}}}]}}`), &pod); err != nil {
+		t.Fatal(err)
+	}
+	res.pods = []PodJSON{pod}
+	res.pvcs = make([]PVCJSON, 1)
+	res.pvcs[0].Metadata.Name = "data-demo-0"
+	res.events = make([]EventJSON, maxDetailEvents+5)
+
+	var ns NamespaceJSON
+	ns.Metadata.Annotations = map[string]string{"kubehatch.io/owner": "alice", "other.io/x": "y", "kubehatch.io/params": `{"ha":true}`}
+	info := VclusterInfo{Name: "demo", Endpoint: "https://demo.example.com"}
+
+	detail := buildVclusterDetail(info, ns, res, map[string][2]string{"demo-0": {"10m", "64Mi"}})
+	if detail.Service == nil || detail.Service.External != info.Endpoint || detail.Service.Type != "ClusterIP" {
+		t.Errorf("service = %+v", detail.Service)
+	}
+	if len(detail.Pods) != 1 || detail.Pods[0].Restarts != 2 || detail.Pods[0].CPU != "10m" || detail.Pods[0].Containers[0].State != "Waiting" {
+		t.Errorf("pods = %+v", detail.Pods)
+	}
+	if len(detail.Volumes) != 1 || len(detail.Events) != maxDetailEvents {
+		t.Errorf("got %d volumes and %d events", len(detail.Volumes), len(detail.Events))
+	}
+	if _, ok := detail.Annotations["other.io/x"]; ok || detail.Parameters == nil || !detail.Parameters.HA {
+		t.Errorf("annotations = %v, parameters = %+v", detail.Annotations, detail.Parameters)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Exposure modes for the virtual API server.
+const (
+	ExposureNone         = "none"
+	ExposureLoadBalancer = "loadbalancer"
+	ExposureIngress      = "ingress"
+	ExposureNodePort     = "nodeport"
+)
+
+var validExposures = map[string]bool{
+	ExposureNone:         true,
+	ExposureLoadBalancer: true,
+	ExposureIngress:      true,
+	ExposureNodePort:     true,
+}
+
+// NodeJSON is used to parse the addresses of host nodes.
+type NodeJSON struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Unschedulable bool `json:"unschedulable"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// ingressBaseDomain is the domain under which ingress-exposed clusters are
+// published as <name>.<baseDomain>. Ingress exposure is unavailable without it.
+func ingressBaseDomain() string {
+	return currentConfig().Ingress.BaseDomain
+}
+
+// ingressClassName is the ingress class used for exposed clusters. The
+// controller must support TLS passthrough (for ingress-nginx, start it with
+// --enable-ssl-passthrough).
+func ingressClassName() string {
+	return currentConfig().Ingress.ClassName
+}
+
+// parseExposure validates an exposure mode, mapping the legacy loadbalancer
+// checkbox onto the new modes when no mode is given.
+func parseExposure(exposure string, legacyLoadBalancer bool) (string, error) {
+	if exposure == "" {
+		if legacyLoadBalancer {
+			return ExposureLoadBalancer, nil
+		}
+		return ExposureNone, nil
+	}
+	if !validExposures[exposure] {
+		return "", fmt.Errorf("unknown exposure %q, expected none, loadbalancer, ingress or nodeport", exposure)
+	}
+	if exposure == ExposureIngress && ingressBaseDomain() == "" {
+		return "", fmt.Errorf("ingress exposure is not configured (ingress.baseDomain is unset)")
+	}
+	return exposure, nil
+}
+
+// ExposureMode returns the exposure mode of the parameters. Parameters stored
+// before exposure modes existed only record the LoadBalancer flag.
+func (p ClusterParams) ExposureMode() string {
+	if p.Exposure != "" {
+		return p.Exposure
+	}
+	if p.LoadBalancer {
+		return ExposureLoadBalancer
+	}
+	return ExposureNone
+}
+
+// ingressHost returns the hostname an ingress-exposed cluster is served on.
+func ingressHost(clusterName string) string {
+	return clusterName + "." + ingressBaseDomain()
+}
+
+// tlsSANs returns the extra names the virtual API server certificate must
+// carry for the given exposure mode.
+func tlsSANs(clusterName string, params ClusterParams) []string {
+	switch params.ExposureMode() {
+	case ExposureIngress:
+		return []string{ingressHost(clusterName)}
+	case ExposureNodePort:
+		if params.NodeAddress != "" {
+			return []string{params.NodeAddress}
+		}
+	}
+	return nil
+}
+
+// nodeAddressOverride is an explicit address to use for NodePort exposure,
+// e.g. 127.0.0.1 for kind with extraPortMappings or a DNS name that resolves
+// to the nodes.
+func nodeAddressOverride() string {
+	return currentConfig().NodePort.Address
+}
+
+// nodeAddressTypes is the order in which node address types are tried for
+// NodePort exposure.
+func nodeAddressTypes() []string {
+	return currentConfig().NodePort.AddressTypes
+}
+
+// discoverNodeAddress picks the address clients should use to reach NodePort
+// services: the explicit override if set, otherwise the first address of a
+// preferred type on a ready, schedulable node.
+func discoverNodeAddress(ctx context.Context, hostKubeconfig string) (string, error) {
+	if addr := nodeAddressOverride(); addr != "" {
+		return addr, nil
+	}
+
+	args := []string{"get", "nodes", "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %v, output: %s", err, string(out))
+	}
+	var list struct {
+		Items []NodeJSON `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return "", fmt.Errorf("failed to parse node list: %v", err)
+	}
+
+	var ready []NodeJSON
+	for _, node := range list.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, c := range node.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				ready = append(ready, node)
+			}
+		}
+	}
+	for _, addrType := range nodeAddressTypes() {
+		for _, node := range ready {
+			for _, a := range node.Status.Addresses {
+				if a.Type == addrType && a.Address != "" {
+					logger(ctx).Info("using node address for NodePort exposure", "type", addrType, "address", a.Address, "node", node.Metadata.Name)
+					return a.Address, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no ready node has an address of type %s; set KUBEHATCH_NODEPORT_ADDRESS", strings.Join(nodeAddressTypes(), " or "))
+}
+
+// getNodePortEndpoint returns https://<address>:<nodePort> for the cluster's service.
+func getNodePortEndpoint(ctx context.Context, hostKubeconfig, clusterName, address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("no node address recorded for cluster %s", clusterName)
+	}
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "svc", clusterName, "-n", namespace, "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return "", fmt.Errorf("failed to get service: %v", err)
+	}
+	var svc ServiceJSON
+	if err := json.Unmarshal(out, &svc); err != nil {
+		return "", fmt.Errorf("failed to parse service: %v", err)
+	}
+	return nodePortEndpoint(svc, clusterName, address)
+}
+
+// nodePortEndpoint returns the URL of a NodePort service's https port on the
+// node address.
+func nodePortEndpoint(svc ServiceJSON, clusterName, address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("no node address recorded for cluster %s", clusterName)
+	}
+	if svc.Spec.Type != "NodePort" {
+		return "", fmt.Errorf("service %s is of type %s, not NodePort", clusterName, svc.Spec.Type)
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.NodePort != 0 && (p.Name == "https" || len(svc.Spec.Ports) == 1) {
+			return "https://" + net.JoinHostPort(address, strconv.Itoa(p.NodePort)), nil
+		}
+	}
+	return "", fmt.Errorf("service %s has no https node port", clusterName)
+}
+
+// applyIngress creates or updates the TLS passthrough Ingress in front of the
+// virtual API server.
+func applyIngress(ctx context.Context, hostKubeconfig, clusterName string) error {
+	namespace := "vcluster-" + clusterName
+	ingress := map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "Ingress",
+		"metadata": map[string]interface{}{
+			"name":      clusterName,
+			"namespace": namespace,
+			"labels":    map[string]string{"app.kubernetes.io/managed-by": "kubehatch"},
+			"annotations": map[string]string{
+				"nginx.ingress.kubernetes.io/ssl-passthrough":  "true",
+				"nginx.ingress.kubernetes.io/backend-protocol": "HTTPS",
+			},
+		},
+		"spec": map[string]interface{}{
+			"ingressClassName": ingressClassName(),
+			"rules": []interface{}{
+				map[string]interface{}{
+					"host": ingressHost(clusterName),
+					"http": map[string]interface{}{
+						"paths": []interface{}{
+							map[string]interface{}{
+								"path":     "/",
+								"pathType": "ImplementationSpecific",
+								"backend": map[string]interface{}{
+									"service": map[string]interface{}{
+										"name": clusterName,
+										"port": map[string]interface{}{"number": 443},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(ingress)
+	if err != nil {
+		return err
+	}
+	args := []string{"apply", "-f", "-"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to apply ingress: %v, output: %s", err, string(out))
+	}
+	logger(ctx).Info("exposed cluster via ingress", "cluster", clusterName, "host", ingressHost(clusterName))
+	return nil
+}
+
+// deleteIngress removes the Ingress created by applyIngress, if any.
+func deleteIngress(ctx context.Context, hostKubeconfig, clusterName string) error {
+	namespace := "vcluster-" + clusterName
+	args := []string{"delete", "ingress", clusterName, "-n", namespace, "--ignore-not-found"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return fmt.Errorf("failed to delete ingress: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// exposureEndpoint returns the external API server URL for the exposure mode,
+// or "" when the cluster is not exposed. With wait set, a LoadBalancer is
+// polled until it has an address.
+func exposureEndpoint(ctx context.Context, hostKubeconfig, clusterName string, params ClusterParams, wait bool) (string, error) {
+	switch params.ExposureMode() {
+	case ExposureLoadBalancer:
+		if wait {
+			return pollForExternalEndpoint(ctx, hostKubeconfig, clusterName)
+		}
+		return getExternalEndpoint(ctx, hostKubeconfig, clusterName)
+	case ExposureIngress:
+		return "https://" + ingressHost(clusterName), nil
+	case ExposureNodePort:
+		return getNodePortEndpoint(ctx, hostKubeconfig, clusterName, params.NodeAddress)
+	default:
+		return "", nil
+	}
+}
+
+// patchExposureEndpoint points a kubeconfig at the external endpoint of the
+// cluster. Failures are logged and leave the kubeconfig unchanged, as before.
+func patchExposureEndpoint(ctx context.Context, kcData []byte, hostKubeconfig, clusterName string, params ClusterParams, wait bool) []byte {
+	if params.ExposureMode() == ExposureNone {
+		return kcData
+	}
+	endpoint, err := exposureEndpoint(ctx, hostKubeconfig, clusterName, params, wait)
+	if err != nil || endpoint == "" {
+		if err != nil {
+			logger(ctx).Warn("no external endpoint", "cluster", clusterName, "err", err)
+		}
+		return kcData
+	}
+	updated, err := updateKubeconfigEndpoint(kcData, endpoint)
+	if err != nil {
+		logger(ctx).Warn("updating kubeconfig endpoint failed", "cluster", clusterName, "err", err)
+		return kcData
+	}
+	return updated
+}
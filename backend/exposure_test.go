@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseExposure(t *testing.T) {
+	tests := []struct {
+		name         string
+		exposure     string
+		loadBalancer bool
+		baseDomain   string
+		want         string
+		wantErr      string
+	}{
+		{"default", "", false, "", ExposureNone, ""},
+		{"legacy loadbalancer", "", true, "", ExposureLoadBalancer, ""},
+		{"mode wins over legacy flag", ExposureNodePort, true, "", ExposureNodePort, ""},
+		{"none", ExposureNone, false, "", ExposureNone, ""},
+		{"loadbalancer", ExposureLoadBalancer, false, "", ExposureLoadBalancer, ""},
+		{"nodeport", ExposureNodePort, false, "", ExposureNodePort, ""},
+		{"ingress", ExposureIngress, false, "dev.example.com", ExposureIngress, ""},
+		{"ingress without domain", ExposureIngress, false, "", "", "ingress exposure is not configured"},
+		{"unknown", "route", false, "", "", `unknown exposure "route"`},
+		{"case sensitive", "LoadBalancer", false, "", "", "unknown exposure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Ingress.BaseDomain = tt.baseDomain
+			useConfig(t, cfg)
+			got, err := parseExposure(tt.exposure, tt.loadBalancer)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseExposure(%q, %v) error = %v, want it to contain %q", tt.exposure, tt.loadBalancer, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseExposure(%q, %v) = %q, %v, want %q", tt.exposure, tt.loadBalancer, got, err, tt.want)
+			}
+		})
+	}
+}
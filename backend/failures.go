@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Failure policies for clusters whose create failed after the namespace was
+// made.
+const (
+	FailurePolicyKeep   = "keep"
+	FailurePolicyDelete = "delete"
+)
+
+// StatusFailed marks a cluster whose create failed and that is kept for
+// debugging.
+const StatusFailed = "Failed"
+
+// Namespace annotations recording a failed create.
+const (
+	annotationFailedStage   = "kubehatch.io/failed-stage"
+	annotationFailedMessage = "kubehatch.io/failed-message"
+	annotationDeleteAfter   = "kubehatch.io/delete-after"
+)
+
+// maxFailureMessage bounds the error stored on the namespace.
+const maxFailureMessage = 1024
+
+// failedClusterReapInterval is how often failed clusters past their TTL are
+// looked for.
+const failedClusterReapInterval = time.Minute
+
+// ClusterFailure is the recorded failure of a kept cluster.
+type ClusterFailure struct {
+	Stage       string
+	Message     string
+	DeleteAfter time.Time
+}
+
+// handleFailedCreate applies failedClusters.policy to a cluster whose create
+// failed at stage and returns a note for the error response. Clusters on
+// uploaded hosts are always deleted: KubeHatch keeps no credentials to reap
+// them later.
+func handleFailedCreate(ctx context.Context, hostKubeconfig, clusterName, stage, msg string, uploaded bool) string {
+	policy := currentConfig().FailedClusters
+	if policy.Policy == FailurePolicyDelete || uploaded {
+		if err := rollbackCreate(ctx, hostKubeconfig, clusterName); err != nil {
+			logger(ctx).Error("deleting failed cluster failed", "cluster", clusterName, "err", err)
+			return "deleting the failed cluster failed: " + err.Error()
+		}
+		logger(ctx).Info("deleted failed cluster", "cluster", clusterName, "stage", stage)
+		return "the cluster was deleted"
+	}
+
+	deleteAfter := time.Now().Add(policy.TTL.Duration).UTC()
+	if err := markClusterFailed(ctx, hostKubeconfig, clusterName, stage, msg, deleteAfter); err != nil {
+		logger(ctx).Error("recording the failure on the cluster failed", "cluster", clusterName, "err", err)
+		return "the cluster is kept but recording the failure on it failed: " + err.Error()
+	}
+	logger(ctx).Info("kept failed cluster for debugging", "cluster", clusterName, "stage", stage, "delete_after", deleteAfter)
+	return fmt.Sprintf("the cluster is kept for debugging until %s", deleteAfter.Format(time.RFC3339))
+}
+
+func markClusterFailed(ctx context.Context, hostKubeconfig, clusterName, stage, msg string, deleteAfter time.Time) error {
+	msg = truncateUTF8(msg, maxFailureMessage)
+	args := []string{"annotate", "namespace", "vcluster-" + clusterName, "--overwrite",
+		annotationFailedStage + "=" + stage,
+		annotationFailedMessage + "=" + msg,
+		annotationDeleteAfter + "=" + deleteAfter.Format(time.RFC3339),
+	}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, string(out))
+	}
+	auditEvent(ctx, auditSystemActor, AuditTTLChange, clusterName, map[string]interface{}{"deleteAfter": deleteAfter.Format(time.RFC3339), "failedStage": stage})
+	return nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// clusterFailure reads the failure recorded on a namespace's annotations.
+func clusterFailure(annotations map[string]string) (ClusterFailure, bool) {
+	stage, ok := annotations[annotationFailedStage]
+	if !ok {
+		return ClusterFailure{}, false
+	}
+	deleteAfter, _ := time.Parse(time.RFC3339, annotations[annotationDeleteAfter])
+	return ClusterFailure{Stage: stage, Message: annotations[annotationFailedMessage], DeleteAfter: deleteAfter}, true
+}
+
+// reapFailedClusters deletes failed clusters on the default host once their
+// delete-after time has passed, until ctx is done. Failed clusters are only
+// kept on the default host, but those kept before hostKubeconfig pointed
+// elsewhere are left alone.
+func reapFailedClusters(ctx context.Context) {
+	ticker := time.NewTicker(failedClusterReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reapFailedClustersOnce(ctx)
+	}
+}
+
+func reapFailedClustersOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, rollbackTimeout)
+	defer cancel()
+	hostKubeconfig := getDefaultKubeconfig()
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		logger(ctx).Warn("listing clusters to reap failed", "err", err)
+	}
+	for _, ns := range namespaces {
+		failure, ok := clusterFailure(ns.Metadata.Annotations)
+		if !ok || failure.DeleteAfter.IsZero() || time.Now().Before(failure.DeleteAfter) {
+			continue
+		}
+		clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+		if err := rollbackCreate(ctx, hostKubeconfig, clusterName); err != nil {
+			logger(ctx).Error("reaping failed cluster failed", "cluster", clusterName, "err", err)
+			continue
+		}
+		logger(ctx).Info("reaped failed cluster", "cluster", clusterName, "stage", failure.Stage)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestClusterFailure(t *testing.T) {
+	deleteAfter := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        ClusterFailure
+		failed      bool
+	}{
+		{"no annotations", nil, ClusterFailure{}, false},
+		{"healthy cluster", map[string]string{"kubehatch.io/owner": "alice"}, ClusterFailure{}, false},
+		{"message without stage", map[string]string{annotationFailedMessage: "boom"}, ClusterFailure{}, false},
+		{"failed", map[string]string{
+			annotationFailedStage:   "install",
+			annotationFailedMessage: "helm timed out",
+			annotationDeleteAfter:   "2026-05-01T12:00:00Z",
+		}, ClusterFailure{Stage: "install", Message: "helm timed out", DeleteAfter: deleteAfter}, true},
+		{"no delete-after", map[string]string{annotationFailedStage: "expose"}, ClusterFailure{Stage: "expose"}, true},
+		{"bad delete-after", map[string]string{annotationFailedStage: "ready", annotationDeleteAfter: "tomorrow"}, ClusterFailure{Stage: "ready"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, failed := clusterFailure(tt.annotations)
+			if failed != tt.failed || got.Stage != tt.want.Stage || got.Message != tt.want.Message || !got.DeleteAfter.Equal(tt.want.DeleteAfter) {
+				t.Errorf("clusterFailure() = %+v, %v, want %+v, %v", got, failed, tt.want, tt.failed)
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exact", 5, "exact"},
+		{"ascii text", 5, "ascii"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本語", 4, "日"},
+		{"日本語", 2, ""},
+		{"🙂!", 3, ""},
+		{"🙂!", 4, "🙂"},
+	}
+	for _, tt := range tests {
+		got := truncateUTF8(tt.s, tt.n)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Condition types reported for every vcluster.
+const (
+	ConditionControlPlaneReady       = "ControlPlaneReady"
+	ConditionAPIServerReachable      = "APIServerReachable"
+	ConditionSyncerHealthy           = "SyncerHealthy"
+	ConditionLoadBalancerProvisioned = "LoadBalancerProvisioned"
+	ConditionStorageBound            = "StorageBound"
+)
+
+// Cluster states shown in the UI.
+const (
+	StatusRunning = "Running"
+	StatusPending = "Pending"
+	StatusError   = "Error"
+	StatusUnknown = "Unknown"
+)
+
+// Condition reports one aspect of a vcluster's health, in the style of
+// Kubernetes status conditions.
+type Condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"` // True, False or Unknown
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ContainerStateJSON is the state of a single container in a pod status.
+type ContainerStateJSON struct {
+	Waiting *struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"waiting,omitempty"`
+	Terminated *struct {
+		Reason   string `json:"reason"`
+		Message  string `json:"message"`
+		ExitCode int    `json:"exitCode"`
+	} `json:"terminated,omitempty"`
+}
+
+// PodJSON is used to parse the control-plane pods of a vcluster.
+type PodJSON struct {
+	Metadata struct {
+		Name              string    `json:"name"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Reason     string `json:"reason"`
+		Message    string `json:"message"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+		ContainerStatuses []struct {
+			Name         string             `json:"name"`
+			Ready        bool               `json:"ready"`
+			RestartCount int                `json:"restartCount"`
+			State        ContainerStateJSON `json:"state"`
+			LastState    ContainerStateJSON `json:"lastState"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// PVCJSON is used to parse the persistent volume claims of a vcluster.
+type PVCJSON struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		StorageClassName string `json:"storageClassName"`
+		Resources        struct {
+			Requests map[string]string `json:"requests"`
+		} `json:"resources"`
+	} `json:"spec"`
+	Status struct {
+		Phase    string            `json:"phase"`
+		Capacity map[string]string `json:"capacity"`
+	} `json:"status"`
+}
+
+// EventJSON is used to parse host events in a vcluster namespace.
+type EventJSON struct {
+	Type           string `json:"type"`
+	Reason         string `json:"reason"`
+	Message        string `json:"message"`
+	Count          int    `json:"count"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	EventTime      time.Time `json:"eventTime"`
+}
+
+// When returns the most meaningful timestamp of the event.
+func (e EventJSON) When() time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime
+	}
+	return e.FirstTimestamp
+}
+
+// Container waiting reasons that will not resolve on their own.
+var fatalWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Event reasons that indicate a failure rather than a transient state.
+var fatalEventReasons = map[string]bool{
+	"ProvisioningFailed": true,
+	"FailedMount":        true,
+	"FailedCreate":       true,
+}
+
+// getControlPlanePods returns the pods of the vcluster control plane, excluding
+// workloads the syncer has created in the same namespace.
+func getControlPlanePods(ctx context.Context, hostKubeconfig, clusterName string) ([]PodJSON, error) {
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "pods", "-n", namespace, "-l", "app=vcluster,release=" + clusterName, "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v, output: %s", err, string(out))
+	}
+	var list struct {
+		Items []PodJSON `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse pod list: %v", err)
+	}
+	return list.Items, nil
+}
+
+// clusterResources are the host objects in a vcluster namespace that its
+// health is derived from.
+type clusterResources struct {
+	sts    *StatefulSetJSON
+	svc    *ServiceJSON
+	pods   []PodJSON // control-plane pods only
+	pvcs   []PVCJSON
+	events []EventJSON // newest first
+}
+
+// getClusterResources fetches the StatefulSet, service, pods, PVCs and events
+// of a vcluster namespace with a single kubectl call.
+func getClusterResources(ctx context.Context, hostKubeconfig, clusterName string) (clusterResources, error) {
+	var res clusterResources
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "statefulsets,services,pods,persistentvolumeclaims,events", "-n", namespace, "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommandOutput(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return res, fmt.Errorf("failed to list namespace resources: %v", err)
+	}
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return res, fmt.Errorf("failed to parse namespace resources: %v", err)
+	}
+	for _, raw := range list.Items {
+		var item struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return res, fmt.Errorf("failed to parse namespace resources: %v", err)
+		}
+		switch {
+		case item.Kind == "StatefulSet" && item.Metadata.Name == clusterName:
+			res.sts = &StatefulSetJSON{}
+			err = json.Unmarshal(raw, res.sts)
+		case item.Kind == "Service" && item.Metadata.Name == clusterName:
+			res.svc = &ServiceJSON{}
+			err = json.Unmarshal(raw, res.svc)
+		case item.Kind == "Pod" && item.Metadata.Labels["app"] == "vcluster" && item.Metadata.Labels["release"] == clusterName:
+			var pod PodJSON
+			err = json.Unmarshal(raw, &pod)
+			res.pods = append(res.pods, pod)
+		case item.Kind == "PersistentVolumeClaim":
+			var pvc PVCJSON
+			err = json.Unmarshal(raw, &pvc)
+			res.pvcs = append(res.pvcs, pvc)
+		case item.Kind == "Event":
+			var event EventJSON
+			err = json.Unmarshal(raw, &event)
+			res.events = append(res.events, event)
+		}
+		if err != nil {
+			return res, fmt.Errorf("failed to parse %s %s: %v", item.Kind, item.Metadata.Name, err)
+		}
+	}
+	sort.Slice(res.events, func(i, j int) bool {
+		return res.events[i].When().After(res.events[j].When())
+	})
+	return res, nil
+}
+
+// latestWarning returns the newest warning event for the given object, if any.
+func latestWarning(events []EventJSON, kind, name string) (EventJSON, bool) {
+	for _, e := range events {
+		if e.Type == "Warning" && e.InvolvedObject.Kind == kind && e.InvolvedObject.Name == name {
+			return e, true
+		}
+	}
+	return EventJSON{}, false
+}
+
+// probeReadyz checks the virtual API server's /readyz endpoint using the
+// admin credentials from the vc-<name> secret.
+func probeReadyz(ctx context.Context, hostKubeconfig, clusterName, externalEndpoint string) Condition {
+	cond := Condition{Type: ConditionAPIServerReachable, Status: "Unknown"}
+
+	kcData, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, externalEndpoint)
+	if err != nil {
+		cond.Reason = "KubeconfigUnavailable"
+		cond.Message = err.Error()
+		return cond
+	}
+	return readyzCondition(ctx, kcData)
+}
+
+// readyzCondition probes /readyz with the given kubeconfig.
+func readyzCondition(ctx context.Context, kcData []byte) Condition {
+	cond := Condition{Type: ConditionAPIServerReachable, Status: "Unknown"}
+	probeOut, err := runVirtualKubectl(ctx, kcData, nil, "--request-timeout=5s", "get", "--raw", "/readyz")
+	result := strings.TrimSpace(string(probeOut))
+	switch {
+	case err == nil && result == "ok":
+		cond.Status = "True"
+		cond.Reason = "ReadyzOK"
+	case err == nil:
+		cond.Status = "False"
+		cond.Reason = "ReadyzNotOK"
+		cond.Message = result
+	case strings.Contains(result, "connection refused") || strings.Contains(result, "i/o timeout") ||
+		strings.Contains(result, "no such host") || strings.Contains(result, "deadline exceeded"):
+		// The backend may simply have no route to the service (e.g. local development).
+		cond.Reason = "Unreachable"
+		cond.Message = result
+	default:
+		cond.Status = "False"
+		cond.Reason = "ReadyzFailed"
+		cond.Message = result
+	}
+	return cond
+}
+
+// assessHealth derives the health conditions of a vcluster from its StatefulSet,
+// control-plane pods, PVCs, host events and, with probe set, a live /readyz
+// probe, and summarises them into an overall status, reason and message. resErr
+// is the error fetching res, if any.
+func assessHealth(ctx context.Context, hostKubeconfig, clusterName string, res clusterResources, resErr error, loadBalancer bool, endpoint string, probe bool) ([]Condition, string, string, string) {
+	sts, pods, pvcs, events := res.sts, res.pods, res.pvcs, res.events
+	fatal := false
+
+	// ControlPlaneReady
+	controlPlane := Condition{Type: ConditionControlPlaneReady}
+	switch {
+	case sts == nil:
+		controlPlane.Status = "False"
+		controlPlane.Reason = "StatefulSetNotFound"
+		controlPlane.Message = "control plane StatefulSet does not exist yet"
+	case sts.Spec.Replicas > 0 && sts.Status.ReadyReplicas == sts.Spec.Replicas:
+		controlPlane.Status = "True"
+		controlPlane.Reason = "AllReplicasReady"
+		controlPlane.Message = fmt.Sprintf("%d/%d replicas ready", sts.Status.ReadyReplicas, sts.Spec.Replicas)
+	default:
+		controlPlane.Status = "False"
+		controlPlane.Reason = "ReplicasNotReady"
+		controlPlane.Message = fmt.Sprintf("%d/%d replicas ready", sts.Status.ReadyReplicas, sts.Spec.Replicas)
+	}
+
+	// SyncerHealthy
+	syncer := Condition{Type: ConditionSyncerHealthy, Status: "Unknown"}
+	if resErr != nil {
+		syncer.Reason = "PodsUnavailable"
+		syncer.Message = resErr.Error()
+	} else if len(pods) == 0 {
+		syncer.Status = "False"
+		syncer.Reason = "NoPods"
+		syncer.Message = "no control plane pods found"
+	} else {
+		syncer.Status = "True"
+		syncer.Reason = "ContainersReady"
+		for _, pod := range pods {
+			if pod.Status.Phase == "Failed" {
+				syncer.Status = "False"
+				syncer.Reason = "PodFailed"
+				syncer.Message = fmt.Sprintf("pod %s failed: %s", pod.Metadata.Name, pod.Status.Message)
+				fatal = true
+				break
+			}
+			if pod.Status.Phase == "Pending" {
+				syncer.Status = "False"
+				syncer.Reason = "PodPending"
+				syncer.Message = fmt.Sprintf("pod %s is pending", pod.Metadata.Name)
+				for _, c := range pod.Status.Conditions {
+					if c.Type == "PodScheduled" && c.Status == "False" {
+						syncer.Reason = c.Reason
+						syncer.Message = c.Message
+					}
+				}
+				continue
+			}
+			for _, cs := range pod.Status.ContainerStatuses {
+				if cs.State.Waiting != nil && fatalWaitingReasons[cs.State.Waiting.Reason] {
+					syncer.Status = "False"
+					syncer.Reason = cs.State.Waiting.Reason
+					syncer.Message = fmt.Sprintf("container %s in pod %s: %s (restarts: %d)", cs.Name, pod.Metadata.Name, cs.State.Waiting.Message, cs.RestartCount)
+					if cs.LastState.Terminated != nil && cs.LastState.Terminated.Reason != "" {
+						syncer.Message += fmt.Sprintf(", last exit: %s (code %d)", cs.LastState.Terminated.Reason, cs.LastState.Terminated.ExitCode)
+					}
+					fatal = true
+				} else if !cs.Ready && syncer.Status == "True" {
+					syncer.Status = "False"
+					syncer.Reason = "ContainerNotReady"
+					syncer.Message = fmt.Sprintf("container %s in pod %s is not ready", cs.Name, pod.Metadata.Name)
+				}
+			}
+		}
+	}
+
+	// StorageBound
+	storage := Condition{Type: ConditionStorageBound, Status: "Unknown"}
+	if resErr != nil {
+		storage.Reason = "PVCsUnavailable"
+		storage.Message = resErr.Error()
+	} else if len(pvcs) == 0 {
+		storage.Status = "True"
+		storage.Reason = "NoPersistentStorage"
+	} else {
+		storage.Status = "True"
+		storage.Reason = "AllBound"
+		for _, pvc := range pvcs {
+			if pvc.Status.Phase == "Bound" {
+				continue
+			}
+			storage.Status = "False"
+			storage.Reason = "PVC" + pvc.Status.Phase
+			storage.Message = fmt.Sprintf("pvc %s is %s", pvc.Metadata.Name, pvc.Status.Phase)
+			if ev, ok := latestWarning(events, "PersistentVolumeClaim", pvc.Metadata.Name); ok {
+				storage.Reason = ev.Reason
+				storage.Message = ev.Message
+				if fatalEventReasons[ev.Reason] {
+					fatal = true
+				}
+			}
+			break
+		}
+	}
+
+	// LoadBalancerProvisioned
+	lb := Condition{Type: ConditionLoadBalancerProvisioned, Status: "True", Reason: "NotRequested"}
+	if loadBalancer {
+		if endpoint != "" {
+			lb.Reason = "IngressAssigned"
+			lb.Message = endpoint
+		} else {
+			lb.Status = "False"
+			lb.Reason = "Pending"
+			lb.Message = "waiting for an external address"
+			if ev, ok := latestWarning(events, "Service", clusterName); ok {
+				lb.Reason = ev.Reason
+				lb.Message = ev.Message
+			}
+		}
+	}
+
+	// APIServerReachable is only probed once the control plane reports ready.
+	api := Condition{Type: ConditionAPIServerReachable, Status: "Unknown", Reason: "ControlPlaneNotReady"}
+	switch {
+	case controlPlane.Status == "True" && probe:
+		api = probeReadyz(ctx, hostKubeconfig, clusterName, endpoint)
+	case controlPlane.Status == "True":
+		api.Reason = "NotProbed"
+	}
+
+	conditions := []Condition{controlPlane, api, syncer, lb, storage}
+
+	status := StatusPending
+	switch {
+	case fatal:
+		status = StatusError
+	case controlPlane.Status == "True" && api.Status != "False":
+		status = StatusRunning
+	}
+
+	var reason, message string
+	for _, c := range conditions {
+		if c.Status != "False" {
+			continue
+		}
+		if status == StatusError && !isFatalReason(c.Reason) {
+			continue
+		}
+		reason, message = c.Reason, c.Message
+		break
+	}
+	return conditions, status, reason, message
+}
+
+func isFatalReason(reason string) bool {
+	return fatalWaitingReasons[reason] || fatalEventReasons[reason] || reason == "PodFailed"
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A create that carries an Idempotency-Key header, or a requestId form field,
+// runs once per user and key. A retry while it runs gets the operation, a
+// retry after it finished gets the same response again, failures included,
+// for idempotency.window. With coordination the keys are kept in Secrets, so
+// a retry may reach any replica.
+
+// maxIdempotencyKey bounds the length of a client-supplied key.
+const maxIdempotencyKey = 255
+
+// idempotencyRetryAfter is suggested to retries of a create that still runs.
+const idempotencyRetryAfter = 10 * time.Second
+
+// replayedHeaders are stored with a result and sent again with it.
+var replayedHeaders = []string{"Content-Type", "X-Operation-Id", "X-Kubehatch-Credential-Id", "X-Kubehatch-Expires-At"}
+
+type idempotencyEntry struct {
+	Fingerprint string      `json:"fingerprint"`
+	OpID        string      `json:"operationId,omitempty"`
+	Replica     string      `json:"replica,omitempty"`
+	Done        bool        `json:"done,omitempty"`
+	Finished    time.Time   `json:"finished,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// idempotencyStore keeps the entries by user and key.
+type idempotencyStore interface {
+	// reserve stores entry unless the key is taken, in which case it returns
+	// the entry that holds it.
+	reserve(ctx context.Context, key string, entry idempotencyEntry) (existing idempotencyEntry, taken bool, err error)
+	put(ctx context.Context, key string, entry idempotencyEntry) error
+	remove(ctx context.Context, key string) error
+}
+
+// idempotencyStoreFor returns the store of the running config: in memory, or
+// Secrets shared by the replicas with coordination.
+func idempotencyStoreFor(cfg *Config) idempotencyStore {
+	if cfg.Coordination.Enabled {
+		return clusterIdempotencyStore{}
+	}
+	return memoryIdempotency
+}
+
+// expired reports whether a finished entry is past idempotency.window.
+func (e idempotencyEntry) expired(window time.Duration) bool {
+	return e.Done && time.Since(e.Finished) > window
+}
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+var memoryIdempotency = &memoryIdempotencyStore{entries: map[string]idempotencyEntry{}}
+
+func (s *memoryIdempotencyStore) reserve(ctx context.Context, key string, entry idempotencyEntry) (idempotencyEntry, bool, error) {
+	window := currentConfig().Idempotency.Window.Duration
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.entries {
+		if e.expired(window) {
+			delete(s.entries, k)
+		}
+	}
+	if existing, ok := s.entries[key]; ok {
+		return existing, true, nil
+	}
+	s.entries[key] = entry
+	return entry, false, nil
+}
+
+func (s *memoryIdempotencyStore) put(ctx context.Context, key string, entry idempotencyEntry) error {
+	s.mu.Lock()
+	s.entries[key] = entry
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryIdempotencyStore) remove(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// clusterIdempotencyStore keeps each entry in a Secret in
+// coordination.namespace. The response may hold a kubeconfig, hence Secrets.
+// An entry of a create whose replica is gone, or past the window, may be
+// taken over.
+type clusterIdempotencyStore struct{}
+
+// labelIdempotency marks the Secrets of the idempotency store.
+const labelIdempotency = "kubehatch.io/idempotency"
+
+// SecretJSON is the part of a Secret that is used here.
+type SecretJSON struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+func idempotencySecretName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "kubehatch-idempotency-" + hex.EncodeToString(sum[:20])
+}
+
+func idempotencySecret(key string, entry idempotencyEntry, resourceVersion string) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now()
+	if entry.Done {
+		expires = entry.Finished
+	}
+	var secret SecretJSON
+	secret.APIVersion, secret.Kind = "v1", "Secret"
+	secret.Metadata.Name = idempotencySecretName(key)
+	secret.Metadata.Labels = map[string]string{labelIdempotency: "true"}
+	secret.Metadata.Annotations = map[string]string{
+		annotationDeleteAfter: expires.Add(currentConfig().Idempotency.Window.Duration).UTC().Format(time.RFC3339),
+	}
+	secret.Metadata.ResourceVersion = resourceVersion
+	secret.Data = map[string][]byte{"entry": data}
+	return json.Marshal(secret)
+}
+
+func (clusterIdempotencyStore) get(ctx context.Context, key string) (idempotencyEntry, string, error) {
+	out, err := coordinationKubectl(ctx, nil, "get", "secret", idempotencySecretName(key), "-o", "json")
+	if err != nil {
+		return idempotencyEntry{}, "", fmt.Errorf("getting idempotency key: %v, output: %s", err, string(out))
+	}
+	var secret SecretJSON
+	var entry idempotencyEntry
+	if err := json.Unmarshal(out, &secret); err != nil {
+		return entry, "", fmt.Errorf("parsing idempotency key: %v", err)
+	}
+	if err := json.Unmarshal(secret.Data["entry"], &entry); err != nil {
+		return entry, "", fmt.Errorf("parsing idempotency key: %v", err)
+	}
+	return entry, secret.Metadata.ResourceVersion, nil
+}
+
+func (s clusterIdempotencyStore) reserve(ctx context.Context, key string, entry idempotencyEntry) (idempotencyEntry, bool, error) {
+	manifest, err := idempotencySecret(key, entry, "")
+	if err != nil {
+		return entry, false, err
+	}
+	out, err := coordinationKubectl(ctx, manifest, "create", "-f", "-")
+	if err == nil {
+		return entry, false, nil
+	}
+	if !strings.Contains(string(out), "AlreadyExists") {
+		return entry, false, fmt.Errorf("creating idempotency key: %v, output: %s", err, string(out))
+	}
+	existing, resourceVersion, err := s.get(ctx, key)
+	if err != nil {
+		return entry, false, err
+	}
+	stale := existing.expired(currentConfig().Idempotency.Window.Duration)
+	if !stale && !existing.Done && existing.Replica != replicaID {
+		alive, err := liveReplicas(ctx)
+		if err != nil {
+			return entry, false, err
+		}
+		stale = !alive[existing.Replica]
+	}
+	if !stale {
+		return existing, true, nil
+	}
+	if manifest, err = idempotencySecret(key, entry, resourceVersion); err != nil {
+		return entry, false, err
+	}
+	if out, err := coordinationKubectl(ctx, manifest, "replace", "-f", "-"); err != nil {
+		if strings.Contains(string(out), "Conflict") || strings.Contains(string(out), "the object has been modified") {
+			existing, _, err = s.get(ctx, key)
+			return existing, true, err
+		}
+		return entry, false, fmt.Errorf("taking over idempotency key: %v, output: %s", err, string(out))
+	}
+	return entry, false, nil
+}
+
+func (clusterIdempotencyStore) put(ctx context.Context, key string, entry idempotencyEntry) error {
+	manifest, err := idempotencySecret(key, entry, "")
+	if err != nil {
+		return err
+	}
+	if out, err := coordinationKubectl(ctx, manifest, "replace", "-f", "-"); err != nil {
+		return fmt.Errorf("updating idempotency key: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+func (clusterIdempotencyStore) remove(ctx context.Context, key string) error {
+	if out, err := coordinationKubectl(ctx, nil, "delete", "secret", idempotencySecretName(key), "--ignore-not-found"); err != nil {
+		return fmt.Errorf("deleting idempotency key: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// expireIdempotencyKeys deletes the Secrets of keys past their window.
+func expireIdempotencyKeys(ctx context.Context) {
+	expireSecrets(ctx, labelIdempotency, "idempotency key")
+}
+
+// expireSecrets deletes the Secrets with the label whose delete-after time has
+// passed. kind names them in the log.
+func expireSecrets(ctx context.Context, label, kind string) {
+	out, err := coordinationKubectl(ctx, nil, "get", "secrets", "-l", label+"=true", "-o",
+		`jsonpath={range .items[*]}{.metadata.name} {.metadata.annotations.kubehatch\.io/delete-after}{"\n"}{end}`)
+	if err != nil {
+		logger(ctx).Warn("listing expired secrets failed", "kind", kind, "err", err, "output", string(out))
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, raw, _ := strings.Cut(line, " ")
+		deleteAfter, err := time.Parse(time.RFC3339, raw)
+		if name == "" || err != nil || time.Now().Before(deleteAfter) {
+			continue
+		}
+		if out, err := coordinationKubectl(ctx, nil, "delete", "secret", name, "--ignore-not-found"); err != nil {
+			logger(ctx).Warn("deleting expired secret failed", "kind", kind, "secret", name, "err", err, "output", string(out))
+		}
+	}
+}
+
+// idempotencyKey returns the request's idempotency key, if it has one.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = r.FormValue("requestId")
+	}
+	if len(key) > maxIdempotencyKey {
+		return "", fmt.Errorf("idempotency key is longer than %d characters", maxIdempotencyKey)
+	}
+	return key, nil
+}
+
+// createFingerprint hashes the parameters of a create, to tell a retry from a
+// different create that reuses the key.
+func createFingerprint(r *http.Request) string {
+	h := sha256.New()
+	for _, field := range []string{"clusterName", "pool", "ha", "exposure", "loadbalancer"} {
+		fmt.Fprintf(h, "%s=%s\n", field, r.FormValue(field))
+	}
+	if r.MultipartForm != nil {
+		for _, file := range r.MultipartForm.File["kubeconfigFile"] {
+			fmt.Fprintf(h, "kubeconfigFile=%d\n", file.Size)
+			if f, err := file.Open(); err == nil {
+				io.Copy(h, f)
+				f.Close()
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotentWriter records the response to a create for later retries.
+type idempotentWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	store  idempotencyStore
+	key    string
+	entry  idempotencyEntry
+	status int
+	body   bytes.Buffer
+}
+
+// beginIdempotent reserves the key for the user's create and returns a writer
+// that records the response. If the key is already taken, the running
+// operation or the earlier response is written to w and ok is false.
+func beginIdempotent(w http.ResponseWriter, r *http.Request, user, key string) (iw *idempotentWriter, ok bool) {
+	ctx := r.Context()
+	store := idempotencyStoreFor(currentConfig())
+	storeKey := user + "\x00" + key
+	entry := idempotencyEntry{Fingerprint: createFingerprint(r), Replica: replicaID}
+	e, taken, err := store.reserve(ctx, storeKey, entry)
+	if err != nil {
+		logger(ctx).Error("reserving idempotency key failed", "user", user, "err", err)
+		http.Error(w, "Error reserving idempotency key: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !taken {
+		return &idempotentWriter{ResponseWriter: w, ctx: ctx, store: store, key: storeKey, entry: entry}, true
+	}
+
+	switch {
+	case e.Fingerprint != entry.Fingerprint:
+		logger(ctx).Warn("idempotency key reused with different parameters", "user", user)
+		http.Error(w, "Idempotency key was already used for a create with different parameters", http.StatusUnprocessableEntity)
+	case !e.Done:
+		// The create may run on another replica.
+		info := OperationInfo{ID: e.OpID, Operation: "create", Cluster: r.FormValue("clusterName"), User: user, Replica: e.Replica}
+		operationsMu.Lock()
+		if op, running := operations[e.OpID]; running {
+			info = op.info()
+		}
+		operationsMu.Unlock()
+		logger(ctx).Info("create with this idempotency key is still running", "user", user, "operation", e.OpID)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("X-Operation-Id", e.OpID)
+		w.Header().Set("Retry-After", strconv.Itoa(int(idempotencyRetryAfter.Seconds())))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(info)
+	default:
+		logger(ctx).Info("replaying create for idempotency key", "user", user, "operation", e.OpID, "status", e.Status)
+		for name, values := range e.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(e.Status)
+		w.Write(e.Body)
+	}
+	return nil, false
+}
+
+// setOperation records the operation that runs the create.
+func (w *idempotentWriter) setOperation(id string) {
+	w.entry.OpID = id
+	if err := w.store.put(w.ctx, w.key, w.entry); err != nil {
+		logger(w.ctx).Warn("recording operation of idempotency key failed", "operation", id, "err", err)
+	}
+}
+
+// finish keeps the response for retries. A handler that wrote nothing
+// releases the key.
+func (w *idempotentWriter) finish() {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(w.ctx), persistTimeout)
+	defer cancel()
+	if w.status == 0 {
+		if err := w.store.remove(ctx, w.key); err != nil {
+			logger(ctx).Warn("releasing idempotency key failed", "err", err)
+		}
+		return
+	}
+	header := http.Header{}
+	for _, name := range replayedHeaders {
+		if v := w.Header().Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	w.entry.Done, w.entry.Finished = true, time.Now()
+	w.entry.Status, w.entry.Header, w.entry.Body = w.status, header, w.body.Bytes()
+	if err := w.store.put(ctx, w.key, w.entry); err != nil {
+		logger(ctx).Warn("storing response for idempotency key failed", "operation", w.entry.OpID, "err", err)
+	}
+}
+
+func (w *idempotentWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotentWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
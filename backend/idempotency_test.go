@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateFingerprintHashesUpload(t *testing.T) {
+	fingerprint := func(kubeconfig string) string {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("clusterName", "demo")
+		fw, _ := mw.CreateFormFile("kubeconfigFile", "config")
+		fw.Write([]byte(kubeconfig))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/api/vcluster", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatal(err)
+		}
+		return createFingerprint(r)
+	}
+
+	a, b := fingerprint("server: https://a"), fingerprint("server: https://b")
+	if a == b {
+		t.Error("uploads of the same size with different contents got the same fingerprint")
+	}
+	if a != fingerprint("server: https://a") {
+		t.Error("the same upload got different fingerprints")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultExecTokenTTL is the lifetime of tokens fetched by the exec plugin.
+// kubectl calls back for a new one when it expires, so it can be short.
+const defaultExecTokenTTL = time.Hour
+
+// KubeconfigOptions selects the shape of a kubeconfig returned to a user.
+type KubeconfigOptions struct {
+	// Rename names the cluster, context and user kubehatch-<name> so that
+	// several clusters can be merged into one kubeconfig.
+	Rename bool
+	// Exec replaces the embedded token with an exec credential plugin that
+	// fetches fresh tokens from KubeHatch.
+	Exec bool
+	// Proxy points the kubeconfig at the KubeHatch API proxy instead of the
+	// virtual API server, so it only carries KubeHatch credentials.
+	Proxy bool
+	// BaseURL is the externally visible KubeHatch URL used by the exec plugin
+	// and the proxy.
+	BaseURL string
+}
+
+// parseKubeconfigOptions reads the rename and auth query parameters.
+func parseKubeconfigOptions(r *http.Request) (KubeconfigOptions, error) {
+	q := r.URL.Query()
+	opts := KubeconfigOptions{
+		Rename:  q.Get("rename") == "true" || q.Get("rename") == "1",
+		BaseURL: requestBaseURL(r),
+	}
+	switch q.Get("auth") {
+	case "", "token":
+	case "exec":
+		opts.Exec = true
+	case "proxy":
+		opts.Proxy = true
+	default:
+		return opts, fmt.Errorf("unknown auth %q, expected token, exec or proxy", q.Get("auth"))
+	}
+	return opts, nil
+}
+
+// requestBaseURL reconstructs the URL clients used to reach KubeHatch,
+// honouring the headers set by a fronting ingress or proxy.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return scheme + "://" + host
+}
+
+// buildUserKubeconfig returns the kubeconfig for one cluster in the requested
+// shape. A credential is only minted for token auth; exec auth defers that to
+// the plugin and proxy auth needs none, so the returned credential is nil in
+// those cases.
+func buildUserKubeconfig(ctx context.Context, hostKubeconfig, clusterName, currentUser, role string, ttl time.Duration, opts KubeconfigOptions) ([]byte, *Credential, error) {
+	if opts.Proxy {
+		name := clusterName
+		if opts.Rename {
+			name = "kubehatch-" + clusterName
+		}
+		kcData, err := kubeconfigForProxy(opts.BaseURL, clusterName, currentUser, name)
+		return kcData, nil, err
+	}
+
+	adminKC, err := getKubeconfigFromSecret(ctx, clusterName, hostKubeconfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting kubeconfig: %v", err)
+	}
+
+	var kcData []byte
+	var cred *Credential
+	userName := clusterName + "-" + role
+	if opts.Rename {
+		userName = "kubehatch-" + clusterName
+	}
+	if opts.Exec {
+		tokenURL := fmt.Sprintf("%s/api/vcluster/%s/token?role=%s", opts.BaseURL, url.PathEscape(clusterName), url.QueryEscape(role))
+		kcData, err = kubeconfigWithExec(adminKC, userName, tokenURL)
+	} else {
+		var issued Credential
+		issued, kcData, err = issueCredential(ctx, hostKubeconfig, clusterName, adminKC, currentUser, role, ttl)
+		cred = &issued
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.Rename {
+		if kcData, err = renameKubeconfig(kcData, "kubehatch-"+clusterName); err != nil {
+			return nil, nil, err
+		}
+	}
+	return kcData, cred, nil
+}
+
+// kubeconfigWithExec replaces the users of a kubeconfig with a single user
+// that obtains tokens by calling KubeHatch through curl. Credentials for
+// KubeHatch itself are read from ~/.netrc when present.
+func kubeconfigWithExec(kcData []byte, userName, tokenURL string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(kcData, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconfig: %v", err)
+	}
+	config["users"] = []interface{}{
+		map[string]interface{}{
+			"name": userName,
+			"user": map[string]interface{}{
+				"exec": map[string]interface{}{
+					"apiVersion":         "client.authentication.k8s.io/v1",
+					"command":            "curl",
+					"args":               []string{"-sSf", "--netrc-optional", tokenURL},
+					"interactiveMode":    "Never",
+					"provideClusterInfo": false,
+					"installHint":        "curl is required to fetch KubeHatch credentials",
+				},
+			},
+		},
+	}
+	setContextUser(config, userName)
+	updated, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal kubeconfig: %v", err)
+	}
+	return updated, nil
+}
+
+// setContextUser points every context of a kubeconfig at the given user.
+func setContextUser(config map[string]interface{}, userName string) {
+	contexts, _ := config["contexts"].([]interface{})
+	for _, c := range contexts {
+		entry, ok := c.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		if ctx, ok := entry["context"].(map[interface{}]interface{}); ok {
+			ctx["user"] = userName
+		}
+	}
+}
+
+// renameKubeconfig gives the first cluster, context and user of a kubeconfig
+// the same name and makes that context current. vcluster kubeconfigs contain
+// exactly one of each.
+func renameKubeconfig(kcData []byte, name string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(kcData, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconfig: %v", err)
+	}
+	for _, key := range []string{"clusters", "contexts", "users"} {
+		entries, _ := config[key].([]interface{})
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("kubeconfig missing '%s' field", key)
+		}
+		entry, ok := entries[0].(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("kubeconfig has malformed '%s' entry", key)
+		}
+		entry["name"] = name
+		config[key] = entries[:1]
+	}
+	contexts := config["contexts"].([]interface{})
+	if ctx, ok := contexts[0].(map[interface{}]interface{})["context"].(map[interface{}]interface{}); ok {
+		ctx["cluster"] = name
+		ctx["user"] = name
+	}
+	config["current-context"] = name
+	updated, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal kubeconfig: %v", err)
+	}
+	return updated, nil
+}
+
+// mergeKubeconfigs combines renamed single-cluster kubeconfigs into one.
+// The first kubeconfig's context becomes the current context.
+func mergeKubeconfigs(kubeconfigs [][]byte) ([]byte, error) {
+	merged := map[string]interface{}{
+		"apiVersion":  "v1",
+		"kind":        "Config",
+		"preferences": map[string]interface{}{},
+	}
+	var clusters, contexts, users []interface{}
+	for i, kcData := range kubeconfigs {
+		var config map[string]interface{}
+		if err := yaml.Unmarshal(kcData, &config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal kubeconfig: %v", err)
+		}
+		if i == 0 {
+			merged["current-context"] = config["current-context"]
+		}
+		c, _ := config["clusters"].([]interface{})
+		clusters = append(clusters, c...)
+		c, _ = config["contexts"].([]interface{})
+		contexts = append(contexts, c...)
+		c, _ = config["users"].([]interface{})
+		users = append(users, c...)
+	}
+	merged["clusters"] = clusters
+	merged["contexts"] = contexts
+	merged["users"] = users
+	return yaml.Marshal(merged)
+}
+
+// accessibleClusterNames returns the names of the clusters the user may access.
+func accessibleClusterNames(ctx context.Context, hostKubeconfig, currentUser string) ([]string, error) {
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ns := range namespaces {
+		if canAccessCluster(currentUser, ns.Metadata.Annotations["kubehatch.io/owner"]) {
+			names = append(names, ns.Metadata.Name[len("vcluster-"):])
+		}
+	}
+	return names, nil
+}
+
+// combinedKubeconfigHandler serves GET /api/vclusters/kubeconfig: one
+// kubeconfig with a kubehatch-<name> context for each of the caller's
+// clusters. It accepts the same role, ttl and auth parameters as the
+// per-cluster route. Clusters that cannot be reached are skipped and listed
+// in the X-Kubehatch-Skipped header.
+func combinedKubeconfigHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auditParams := kubeconfigAuditParams(r)
+	w, done := auditAction(w, r, AuditKubeconfig, "", auditParams)
+	defer done()
+	currentUser := getUserFromRequest(r)
+	hostKubeconfig := getDefaultKubeconfig()
+
+	opts, err := parseKubeconfigOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Rename = true
+
+	names, err := accessibleClusterNames(ctx, hostKubeconfig, currentUser)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing clusters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(names) == 0 {
+		http.Error(w, "No clusters found", http.StatusNotFound)
+		return
+	}
+
+	var kubeconfigs [][]byte
+	var skipped []string
+	for _, name := range names {
+		role, ttl, err := parseCredentialRequest(r, currentUser, getClusterOwner(ctx, hostKubeconfig, name))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cluster %s: %v", name, err), http.StatusForbidden)
+			return
+		}
+		kcData, _, err := buildUserKubeconfig(ctx, hostKubeconfig, name, currentUser, role, ttl, opts)
+		if err != nil {
+			logger(ctx).Warn("skipping cluster in combined kubeconfig", "cluster", name, "err", err)
+			skipped = append(skipped, name)
+			continue
+		}
+		kubeconfigs = append(kubeconfigs, kcData)
+	}
+	auditParams["clusters"] = names
+	if len(skipped) > 0 {
+		auditParams["skipped"] = skipped
+	}
+	if len(kubeconfigs) == 0 {
+		http.Error(w, "No cluster kubeconfig could be generated", http.StatusBadGateway)
+		return
+	}
+	merged, err := mergeKubeconfigs(kubeconfigs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error merging kubeconfigs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(skipped) > 0 {
+		data, _ := json.Marshal(skipped)
+		w.Header().Set("X-Kubehatch-Skipped", string(data))
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=kubeconfig-kubehatch.yaml")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(merged)
+}
+
+// execTokenHandler serves GET /api/vcluster/{name}/token for the exec
+// credential plugin, returning a fresh token of the caller's exec credential as
+// an ExecCredential.
+func execTokenHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+	ctx := r.Context()
+	auditParams := kubeconfigAuditParams(r)
+	auditParams["auth"] = "exec"
+	w, done := auditAction(w, r, AuditKubeconfig, clusterName, auditParams)
+	defer done()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
+	role, ttl, err := parseCredentialRequest(r, currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("ttl") == "" {
+		ttl = defaultExecTokenTTL
+	}
+
+	token, expiresAt, err := issueExecToken(ctx, hostKubeconfig, clusterName, currentUser, role, ttl)
+	if err != nil {
+		logger(ctx).Error("issuing token failed", "cluster", clusterName, "err", err)
+		http.Error(w, fmt.Sprintf("Error issuing token: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"apiVersion": "client.authentication.k8s.io/v1",
+		"kind":       "ExecCredential",
+		"status": map[string]interface{}{
+			"token":               token,
+			"expirationTimestamp": expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// kubeconfigAuditParams records the request options of a kubeconfig download.
+func kubeconfigAuditParams(r *http.Request) map[string]interface{} {
+	params := map[string]interface{}{}
+	for _, key := range []string{"role", "ttl", "auth", "rename"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			params[key] = v
+		}
+	}
+	return params
+}
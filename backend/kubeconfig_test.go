@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// vclusterKubeconfig is a kubeconfig as written by vcluster connect.
+const vclusterKubeconfig = `apiVersion: v1
+kind: Config
+current-context: vcluster_demo_vcluster-demo_host
+clusters:
+- name: vcluster_demo_vcluster-demo_host
+  cluster:
+    server: https://10.0.0.5:443
+    certificate-authority-data: Q0E=
+contexts:
+- name: vcluster_demo_vcluster-demo_host
+  context:
+    cluster: vcluster_demo_vcluster-demo_host
+    user: vcluster_demo_vcluster-demo_host
+users:
+- name: vcluster_demo_vcluster-demo_host
+  user:
+    token: abc
+`
+
+type testKubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token string `yaml:"token"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func parseTestKubeconfig(t *testing.T, data []byte) testKubeconfigFile {
+	t.Helper()
+	var kc testKubeconfigFile
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		t.Fatalf("kubeconfig does not parse: %v\n%s", err, data)
+	}
+	return kc
+}
+
+func TestRenameKubeconfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"vcluster kubeconfig", vclusterKubeconfig, ""},
+		{"extra entries are dropped", vclusterKubeconfig + `- name: other
+  user:
+    token: def
+`, ""},
+		{"no users", strings.SplitAfter(vclusterKubeconfig, "users:\n")[0], "missing 'users'"},
+		{"malformed cluster", "clusters: [x]\ncontexts: [{name: a}]\nusers: [{name: a}]\n", "malformed 'clusters'"},
+		{"not yaml", "{", "failed to unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renameKubeconfig([]byte(tt.data), "kubehatch-demo")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renameKubeconfig() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renameKubeconfig() error = %v", err)
+			}
+			kc := parseTestKubeconfig(t, out)
+			if len(kc.Clusters) != 1 || len(kc.Contexts) != 1 || len(kc.Users) != 1 {
+				t.Fatalf("renamed kubeconfig has %d clusters, %d contexts and %d users, want one of each", len(kc.Clusters), len(kc.Contexts), len(kc.Users))
+			}
+			for _, name := range []string{kc.CurrentContext, kc.Clusters[0].Name, kc.Contexts[0].Name, kc.Contexts[0].Context.Cluster, kc.Contexts[0].Context.User, kc.Users[0].Name} {
+				if name != "kubehatch-demo" {
+					t.Errorf("renamed kubeconfig still refers to %q:\n%s", name, out)
+				}
+			}
+			if kc.Users[0].User.Token != "abc" || kc.Clusters[0].Cluster.Server != "https://10.0.0.5:443" {
+				t.Errorf("renaming changed the credentials or server:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestMergeKubeconfigs(t *testing.T) {
+	rename := func(name string) []byte {
+		out, err := renameKubeconfig([]byte(vclusterKubeconfig), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	tests := []struct {
+		name    string
+		names   []string
+		current string
+	}{
+		{"none", nil, ""},
+		{"one", []string{"kubehatch-a"}, "kubehatch-a"},
+		{"several", []string{"kubehatch-b", "kubehatch-a", "kubehatch-c"}, "kubehatch-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var kubeconfigs [][]byte
+			for _, name := range tt.names {
+				kubeconfigs = append(kubeconfigs, rename(name))
+			}
+			out, err := mergeKubeconfigs(kubeconfigs)
+			if err != nil {
+				t.Fatalf("mergeKubeconfigs() error = %v", err)
+			}
+			kc := parseTestKubeconfig(t, out)
+			if kc.CurrentContext != tt.current {
+				t.Errorf("current-context = %q, want %q", kc.CurrentContext, tt.current)
+			}
+			if len(kc.Clusters) != len(tt.names) || len(kc.Contexts) != len(tt.names) || len(kc.Users) != len(tt.names) {
+				t.Fatalf("merged kubeconfig has %d clusters, %d contexts and %d users, want %d of each", len(kc.Clusters), len(kc.Contexts), len(kc.Users), len(tt.names))
+			}
+			for i, name := range tt.names {
+				if kc.Clusters[i].Name != name || kc.Contexts[i].Name != name || kc.Users[i].Name != name {
+					t.Errorf("entry %d is %q/%q/%q, want %q", i, kc.Clusters[i].Name, kc.Contexts[i].Name, kc.Users[i].Name, name)
+				}
+			}
+		})
+	}
+
+	if _, err := mergeKubeconfigs([][]byte{[]byte("{")}); err == nil {
+		t.Error("mergeKubeconfigs(invalid YAML) error = nil")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rootLogger writes JSON lines to stdout at the configured level (debug,
+// info, warn or error; default info). logging.format text switches to
+// logfmt-style output for local use.
+//
+// Kubeconfig paths and contents must never be logged: uploaded kubeconfigs
+// and generated ones are credentials.
+var (
+	logLevel   = new(slog.LevelVar)
+	rootLogger = newRootLogger(defaultConfig().Logging)
+)
+
+// newRootLogger builds the logger for cfg. The level can change later through
+// logLevel, the format is fixed.
+func newRootLogger(cfg LoggingConfig) *slog.Logger {
+	logLevel.Set(parseLogLevel(cfg.Level))
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stdout, opts)
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	logger := slog.New(handler)
+	// Route the standard library logger (e.g. net/http errors) through slog.
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	return logger
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+type requestIDKey struct{}
+
+// validRequestID limits caller-supplied IDs to something safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRequestID returns the caller's X-Request-Id if it is usable, or a new
+// random ID.
+func newRequestID(header string) string {
+	if validRequestID.MatchString(header) {
+		return header
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the correlation ID of the request, or "".
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the logger for ctx, tagged with the request's correlation ID
+// and trace ID when present.
+func logger(ctx context.Context) *slog.Logger {
+	l := rootLogger
+	if id := requestIDFromContext(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if span := spanFromContext(ctx); span != nil && span.sampled {
+		l = l.With("trace_id", hex.EncodeToString(span.traceID[:]))
+	}
+	return l
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	rootLogger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultLogTail = 200
+	maxLogTail     = 5000
+)
+
+// validName matches Kubernetes object and container names.
+var validName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// getLogsHandler streams control-plane logs of a vcluster from its host
+// namespace. Query parameters:
+//
+//	container  container name (default "syncer")
+//	pod        a single control-plane pod (default: all of them)
+//	tail       number of lines per pod (default 200)
+//	previous   "true" for the previous container instance
+//	follow     "true" to keep streaming; served as SSE when the client
+//	           accepts text/event-stream, as chunked text otherwise
+func getLogsHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+
+	q := r.URL.Query()
+	container := q.Get("container")
+	if container == "" {
+		container = "syncer"
+	}
+	if !validName.MatchString(container) {
+		http.Error(w, "invalid container name", http.StatusBadRequest)
+		return
+	}
+	pod := q.Get("pod")
+	if pod != "" && !validName.MatchString(pod) {
+		http.Error(w, "invalid pod name", http.StatusBadRequest)
+		return
+	}
+	tail := defaultLogTail
+	if t := q.Get("tail"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			http.Error(w, "tail must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if n > maxLogTail {
+			n = maxLogTail
+		}
+		tail = n
+	}
+	follow := q.Get("follow") == "true" || q.Get("follow") == "1"
+	previous := q.Get("previous") == "true" || q.Get("previous") == "1"
+	sse := follow && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	namespace := "vcluster-" + clusterName
+	args := []string{"logs", "-n", namespace, "-c", container, "--tail=" + strconv.Itoa(tail)}
+	if pod != "" {
+		args = append(args, pod)
+	} else {
+		args = append(args, "-l", "app=vcluster,release="+clusterName, "--prefix", "--max-log-requests=10")
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+	if previous {
+		args = append(args, "--previous")
+	}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+
+	// The request context stops kubectl when the client goes away.
+	cmd := exec.CommandContext(r.Context(), "kubectl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	home, err := isolateCommand(cmd)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(home)
+	if err := cmd.Start(); err != nil {
+		http.Error(w, fmt.Sprintf("Error reading logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("streaming logs", "cluster", clusterName, "container", container, "follow", follow)
+
+	flusher, _ := w.(http.Flusher)
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	reader := bufio.NewReader(stdout)
+	wrote := false
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			wrote = true
+			if sse {
+				fmt.Fprintf(w, "data: %s\n\n", strings.TrimRight(line, "\n"))
+			} else {
+				io.WriteString(w, line)
+			}
+			if follow && flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err := cmd.Wait(); err != nil && r.Context().Err() == nil {
+		msg := strings.TrimSpace(stderr.String())
+		logger(r.Context()).Error("streaming logs failed", "cluster", clusterName, "err", err, "output", msg)
+		if !wrote {
+			http.Error(w, fmt.Sprintf("Error reading logs: %s", msg), http.StatusBadGateway)
+			return
+		}
+		if sse {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(msg, "\n", " "))
+		}
+	}
+}
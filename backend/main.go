@@ -1,36 +1,49 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
-// VclusterConfig describes the structure of the vcluster.yaml file.
+// VclusterConfig describes the parts of the vcluster.yaml file that are set
+// here.
 type VclusterConfig struct {
-	APIVersion string `yaml:"apiVersion"`
-	Kind       string `yaml:"kind"`
-	Metadata   struct {
-		Name string `yaml:"name"`
-	} `yaml:"metadata"`
-	Spec struct {
-		Replicas int `yaml:"replicas"`
-		Service  struct {
-			Type string `yaml:"type,omitempty"`
-		} `yaml:"service,omitempty"`
-	} `yaml:"spec"`
+	ControlPlane struct {
+		Service struct {
+			Spec struct {
+				Type string `yaml:"type,omitempty"`
+			} `yaml:"spec"`
+		} `yaml:"service"`
+		StatefulSet struct {
+			HighAvailability struct {
+				Replicas int `yaml:"replicas"`
+			} `yaml:"highAvailability"`
+		} `yaml:"statefulSet"`
+		BackingStore struct {
+			Etcd struct {
+				Embedded struct {
+					Enabled bool `yaml:"enabled"`
+				} `yaml:"embedded"`
+			} `yaml:"etcd"`
+		} `yaml:"backingStore,omitempty"`
+		Proxy struct {
+			ExtraSANs []string `yaml:"extraSANs,omitempty"`
+		} `yaml:"proxy,omitempty"`
+	} `yaml:"controlPlane"`
 }
 
 // ServiceJSON is used to parse Kubernetes service JSON output.
@@ -44,35 +57,80 @@ type ServiceJSON struct {
 		} `json:"loadBalancer"`
 	} `json:"status"`
 	Spec struct {
-		Ports []struct {
-			Port int `json:"port"`
+		Type      string `json:"type"`
+		ClusterIP string `json:"clusterIP"`
+		Ports     []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			NodePort int    `json:"nodePort"`
 		} `json:"ports"`
 	} `json:"spec"`
 }
 
 // VclusterResponse is the JSON response that includes the generated kubeconfig.
 type VclusterResponse struct {
-	Kubeconfig string `json:"kubeconfig"`
+	// ClusterName is the cluster's name, generated for creates from a pool.
+	ClusterName string    `json:"clusterName"`
+	Kubeconfig  string    `json:"kubeconfig"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	// DownloadURL is a signed, short-lived link to the same kubeconfig.
+	DownloadURL string `json:"downloadUrl,omitempty"`
 }
 
 // VclusterInfo represents information about a vcluster
 type VclusterInfo struct {
-	Name         string    `json:"name"`
-	Namespace    string    `json:"namespace"`
-	Status       string    `json:"status"`
-	HA           bool      `json:"ha"`
-	LoadBalancer bool      `json:"loadBalancer"`
-	Endpoint     string    `json:"endpoint,omitempty"`
-	CreatedAt    time.Time `json:"createdAt"`
-	Owner        string    `json:"owner,omitempty"` // User/team who created it
+	Name         string      `json:"name"`
+	Namespace    string      `json:"namespace"`
+	Status       string      `json:"status"`
+	HA           bool        `json:"ha"`
+	LoadBalancer bool        `json:"loadBalancer"`
+	Exposure     string      `json:"exposure,omitempty"`
+	Endpoint     string      `json:"endpoint,omitempty"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	Owner        string      `json:"owner,omitempty"`  // User/team who created it
+	Reason       string      `json:"reason,omitempty"` // Why the cluster is not Running
+	Message      string      `json:"message,omitempty"`
+	FailedStage  string      `json:"failedStage,omitempty"` // Stage a kept failed create stopped at
+	DeleteAfter  *time.Time  `json:"deleteAfter,omitempty"` // When a failed cluster is removed
+	Conditions   []Condition `json:"conditions,omitempty"`
+}
+
+// ClusterParams holds the creation parameters stored on the vcluster namespace.
+type ClusterParams struct {
+	HA           bool   `json:"ha"`
+	LoadBalancer bool   `json:"loadBalancer"`
+	Exposure     string `json:"exposure,omitempty"`    // none, loadbalancer, ingress or nodeport
+	NodeAddress  string `json:"nodeAddress,omitempty"` // node address in the TLS SANs for nodeport
+	// EmbeddedEtcd is set once a cluster has run with HA. Its data then lives
+	// in etcd, so it keeps etcd when scaled back to one replica.
+	EmbeddedEtcd bool `json:"embeddedEtcd,omitempty"`
+}
+
+// embeddedEtcd reports whether the cluster is backed by embedded etcd rather
+// than the default SQLite, which cannot be shared by several replicas.
+func (p ClusterParams) embeddedEtcd() bool {
+	return p.HA || p.EmbeddedEtcd
+}
+
+// VclusterPatchRequest is the JSON body accepted by PATCH /api/vcluster/{name}.
+// Fields left unset keep their current value.
+type VclusterPatchRequest struct {
+	HA           *bool   `json:"ha,omitempty"`
+	LoadBalancer *bool   `json:"loadBalancer,omitempty"`
+	Exposure     *string `json:"exposure,omitempty"`
 }
 
 // NamespaceJSON is used to parse Kubernetes namespace JSON output
 type NamespaceJSON struct {
 	Metadata struct {
-		Name              string    `json:"name"`
-		CreationTimestamp time.Time `json:"creationTimestamp"`
+		Name              string            `json:"name"`
+		ResourceVersion   string            `json:"resourceVersion"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		Annotations       map[string]string `json:"annotations"`
 	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
 }
 
 // StatefulSetJSON is used to parse StatefulSet status
@@ -87,19 +145,44 @@ type StatefulSetJSON struct {
 }
 
 func main() {
-	http.HandleFunc("/api/vcluster", corsMiddleware(vclusterHandler))
-	http.HandleFunc("/api/vcluster/", corsMiddleware(vclusterDetailHandler))
-	http.HandleFunc("/api/vclusters", corsMiddleware(vclustersListHandler))
-	http.HandleFunc("/download", corsMiddleware(downloadHandler))
-	log.Println("Backend API running on :8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("loading config failed", "err", err)
+	}
+	activeConfig.Store(cfg)
+	rootLogger = newRootLogger(cfg.Logging)
+	audit = newAuditLog(cfg.Audit.Log)
+	reloadConfigOnHangup()
+	runBackgroundLoops()
+	go countVclusters(backgroundCtx)
+
+	http.HandleFunc("/api/vcluster", instrument(corsMiddleware(vclusterHandler)))
+	http.HandleFunc("/api/vcluster/", instrument(corsMiddleware(vclusterDetailHandler)))
+	http.HandleFunc("/api/vclusters", instrument(corsMiddleware(vclustersListHandler)))
+	http.HandleFunc("/api/vclusters/kubeconfig", instrument(corsMiddleware(combinedKubeconfigHandler)))
+	http.HandleFunc("/download", instrument(corsMiddleware(downloadHandler)))
+	http.HandleFunc("/api/audit", instrument(corsMiddleware(auditHandler)))
+	http.HandleFunc("/api/config", instrument(corsMiddleware(configHandler)))
+	http.HandleFunc("/api/operations", instrument(corsMiddleware(operationsHandler)))
+	http.HandleFunc("/api/operations/", instrument(corsMiddleware(operationsHandler)))
+	http.HandleFunc("/proxy/", instrument(proxyHandler))
+	http.HandleFunc("/metrics", metricsHandler)
+	srv := &http.Server{Addr: cfg.ListenAddr}
+	stopped := shutdownOnTerm(srv)
+	rootLogger.Info("backend API running", "addr", cfg.ListenAddr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fatal("server stopped", "err", err)
+	}
+	<-stopped
+	rootLogger.Info("backend stopped")
 }
 
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Origin", currentConfig().CORSOrigin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-Id, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, X-Operation-Id, Idempotent-Replayed, Retry-After")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -143,6 +226,7 @@ func getUserFromRequest(r *http.Request) string {
 }
 
 func vclusterHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
 		return
@@ -152,123 +236,435 @@ func vclusterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	clusterName := r.FormValue("clusterName")
-	ha := r.FormValue("ha") == "on"
-	useLoadBalancer := r.FormValue("loadbalancer") == "on"
-	if clusterName == "" {
-		http.Error(w, "clusterName is required", http.StatusBadRequest)
-		return
-	}
-
+	poolName := r.FormValue("pool")
 	// Get current user from authentication
 	currentUser := getUserFromRequest(r)
-	log.Printf("Request from user: %s, creating cluster: %s", currentUser, clusterName)
-
+	key, err := idempotencyKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var idem *idempotentWriter
+	if key != "" {
+		var ok bool
+		if idem, ok = beginIdempotent(w, r, currentUser, key); !ok {
+			return
+		}
+		defer idem.finish()
+		w = idem
+	}
+	auditParams := map[string]interface{}{}
+	w, done := auditAction(w, r, AuditCreate, clusterName, auditParams)
+	defer done()
+	// The working directory holds the admin kubeconfig and any uploaded host
+	// kubeconfig; it goes only after the operation has finished with them.
 	reqID := strconv.FormatInt(time.Now().UnixNano(), 10)
 	workingDir := filepath.Join(".", "requests", reqID)
-	if err := os.MkdirAll(workingDir, 0755); err != nil {
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
 		http.Error(w, "Error creating working directory: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer os.RemoveAll(workingDir)
+	op := startOperation(ctx, w, "create", clusterName, currentUser)
+	defer op.finish(w)
+	if idem != nil {
+		idem.setOperation(op.id)
+	}
+	ctx = op.ctx
+	ha := r.FormValue("ha") == "on"
+	exposure, err := parseExposure(r.FormValue("exposure"), r.FormValue("loadbalancer") == "on")
+	if poolName != "" {
+		// A pool fixes the template and generates the name.
+		pool, ok := currentConfig().pool(poolName)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown pool %q", poolName), http.StatusBadRequest)
+			return
+		}
+		if clusterName != "" {
+			http.Error(w, "clusterName cannot be set when claiming from a pool", http.StatusBadRequest)
+			return
+		}
+		ha = pool.HA
+		exposure, err = parseExposure(pool.Exposure, false)
+		auditParams["pool"] = poolName
+	} else if clusterName == "" {
+		http.Error(w, "clusterName is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	useLoadBalancer := exposure == ExposureLoadBalancer
+	params := ClusterParams{HA: ha, LoadBalancer: useLoadBalancer, Exposure: exposure}
+
+	auditParams["ha"] = ha
+	auditParams["exposure"] = exposure
+	auditParams["owner"] = currentUser
+	logger(ctx).Info("creating cluster", "cluster", clusterName, "user", currentUser)
 
 	var hostKubeconfig string
+	uploaded := false
 	file, _, err := r.FormFile("kubeconfigFile")
 	if err == nil && file != nil {
 		defer file.Close()
-		uploadPath := filepath.Join(workingDir, "uploaded.yaml")
-		outFile, err := os.Create(uploadPath)
-		if err != nil {
-			http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+		if poolName != "" {
+			http.Error(w, "Pools are kept on the default host; a host kubeconfig cannot be uploaded with pool", http.StatusBadRequest)
 			return
 		}
-		defer outFile.Close()
-		if _, err = io.Copy(outFile, file); err != nil {
-			http.Error(w, "Error saving uploaded file: "+err.Error(), http.StatusInternalServerError)
+		uploaded = true
+		auditParams["hostKubeconfig"] = "uploaded"
+		if hostKubeconfig, err = saveUploadedKubeconfig(ctx, file, workingDir); err != nil {
+			http.Error(w, "Invalid host kubeconfig: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		hostKubeconfig, err = filepath.Abs(uploadPath)
-		if err != nil {
-			http.Error(w, "Error determining absolute path: "+err.Error(), http.StatusInternalServerError)
+	} else {
+		hostKubeconfig = getDefaultKubeconfig()
+		if hostKubeconfig == "" {
+			logger(ctx).Info("no kubeconfig provided, using in-cluster config")
+		}
+	}
+
+	logger(ctx).Info("cluster parameters", "cluster", clusterName, "ha", ha, "exposure", exposure, "uploaded_kubeconfig", uploaded)
+	op.setAttributes(
+		attrString("enduser.id", currentUser),
+		attrString("kubehatch.host", hostLabel(hostKubeconfig)),
+		attrBool("kubehatch.ha", ha),
+		attrString("kubehatch.exposure", exposure))
+
+	if poolName != "" {
+		ctx = op.setStage("claim")
+		name, claimedParams, err := claimPooledCluster(ctx, hostKubeconfig, poolName, currentUser)
+		switch {
+		case err == nil:
+			op.setCluster(name)
+			auditParams["cluster"] = name
+			if !op.lockCluster(w, ctx) {
+				return
+			}
+			op.persistTo(hostKubeconfig)
+			armCreateRollback(op, hostKubeconfig, name, uploaded)
+			deliverCluster(w, op, workingDir, hostKubeconfig, name, currentUser, claimedParams)
+			return
+		case err == errPoolEmpty:
+			clusterName = newPoolClusterName(poolName)
+			op.setCluster(clusterName)
+			auditParams["cluster"] = clusterName
+			logger(ctx).Info("pool is empty, installing a cluster", "pool", poolName, "cluster", clusterName)
+		default:
+			op.fail(w, fmt.Sprintf("Error claiming from pool %s: %v", poolName, err), http.StatusInternalServerError)
 			return
 		}
-	} else {
-		// Try default kubeconfig path first
-		defaultPath := "/var/secrets/kubeconfig"
-		if _, err := os.Stat(defaultPath); err == nil {
-			hostKubeconfig = defaultPath
-		} else {
-			// If not found, use in-cluster config (empty string means use default kubectl behavior)
-			hostKubeconfig = ""
-			log.Printf("Request %s: No kubeconfig provided, using in-cluster config", reqID)
+	}
+
+	if exposure == ExposureNodePort {
+		ctx = op.setStage("node-address")
+		// The address must be known up front so it can go into the TLS SANs.
+		if params.NodeAddress, err = discoverNodeAddress(ctx, hostKubeconfig); err != nil {
+			op.fail(w, fmt.Sprintf("Error discovering node address: %v", err), http.StatusBadRequest)
+			return
 		}
 	}
 
-	log.Printf("Request %s: User=%s, clusterName=%s, HA=%v, LoadBalancer=%v, kubeconfig=%s", reqID, currentUser, clusterName, ha, useLoadBalancer, hostKubeconfig)
+	ctx = op.setStage("render-config")
+	if err := createVclusterYAML(workingDir, clusterName, params); err != nil {
+		op.fail(w, fmt.Sprintf("Error creating YAML: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	if err := createVclusterYAML(workingDir, clusterName, ha, useLoadBalancer); err != nil {
-		http.Error(w, fmt.Sprintf("Error creating YAML: %v", err), http.StatusInternalServerError)
+	ctx = op.setStage("namespace")
+	if !op.lockCluster(w, ctx) {
+		return
+	}
+	queuedAt, priority := time.Now().UTC(), currentConfig().queuePriority(currentUser)
+	annotations := queueAnnotations(queuedAt, priority)
+	annotations[annotationOperation] = op.record()
+	if err := createClusterNamespace(ctx, hostKubeconfig, clusterName, currentUser, params, annotations); err != nil {
+		status := http.StatusInternalServerError
+		if err == errClusterExists {
+			status = http.StatusConflict
+		}
+		op.fail(w, fmt.Sprintf("Error creating cluster %s: %v", clusterName, err), status)
 		return
 	}
 
-	if err := createVirtualCluster(workingDir, clusterName, hostKubeconfig, useLoadBalancer); err != nil {
-		http.Error(w, fmt.Sprintf("Error creating virtual cluster: %v", err), http.StatusInternalServerError)
+	op.persistTo(hostKubeconfig)
+	armCreateRollback(op, hostKubeconfig, clusterName, uploaded)
+	entry := provisioning.enqueue(op.id, hostLabel(hostKubeconfig), priority, queuedAt)
+	if !installCluster(w, op, entry, workingDir, hostKubeconfig, clusterName, params) {
 		return
 	}
+	deliverCluster(w, op, workingDir, hostKubeconfig, clusterName, currentUser, params)
+}
 
-	// Store user info with cluster (we'll use this for filtering)
-	// For now, vcluster creates namespace as vcluster-<cluster-name>
-	// We'll track ownership separately
-	log.Printf("Request %s: Waiting for 1 minute for the cluster to be ready...", reqID)
-	time.Sleep(1 * time.Minute)
+// installCluster waits for the create's turn in the queue, installs the
+// cluster and waits for its control plane. It writes the error response and
+// returns false if any of that fails.
+func installCluster(w http.ResponseWriter, op *operation, entry *queueEntry, workingDir, hostKubeconfig, clusterName string, params ClusterParams) bool {
+	ctx := op.setStage("queued")
+	release, err := provisioning.wait(ctx, entry)
+	if err != nil {
+		op.fail(w, fmt.Sprintf("Error waiting in the provisioning queue: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	defer release()
+	dequeueCreate(ctx, hostKubeconfig, clusterName)
 
-	if err := fetchAndPatchKubeconfigFromSecret(workingDir, clusterName, hostKubeconfig, useLoadBalancer); err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching kubeconfig from secret: %v", err), http.StatusInternalServerError)
-		return
+	ctx = op.setStage("install")
+	if err := createVirtualCluster(ctx, workingDir, clusterName, hostKubeconfig, params.LoadBalancer); err != nil {
+		op.fail(w, fmt.Sprintf("Error creating virtual cluster: %v", err), http.StatusInternalServerError)
+		return false
+	}
+
+	if params.Exposure == ExposureIngress {
+		ctx = op.setStage("expose")
+		if err := applyIngress(ctx, hostKubeconfig, clusterName); err != nil {
+			op.fail(w, fmt.Sprintf("Error exposing virtual cluster: %v", err), http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	return awaitControlPlane(w, op, hostKubeconfig, clusterName, params)
+}
+
+// awaitControlPlane runs the wait stage of a create, for at most
+// timeouts.readyWait.
+func awaitControlPlane(w http.ResponseWriter, op *operation, hostKubeconfig, clusterName string, params ClusterParams) bool {
+	ctx := op.setStage("wait")
+	replicas := controlPlaneReplicas(params)
+	readyWait := currentConfig().Timeouts.ReadyWait.Duration
+	logger(ctx).Info("waiting for the control plane", "cluster", clusterName, "replicas", replicas)
+	waitCtx, cancelWait := context.WithTimeout(ctx, readyWait)
+	err := waitForControlPlane(waitCtx, hostKubeconfig, clusterName, replicas)
+	cancelWait()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("not ready after %s", readyWait)
+			status = http.StatusGatewayTimeout
+		}
+		op.fail(w, fmt.Sprintf("Error waiting for the control plane: %v", err), status)
+		return false
+	}
+	logger(ctx).Info("control plane ready", "cluster", clusterName, "since_start_s", time.Since(op.start).Seconds())
+	return true
+}
+
+// verifyCluster fetches the admin kubeconfig of a cluster whose control plane
+// is up and waits for its API server. The cluster works once it returns true,
+// so a later failure no longer removes it.
+func verifyCluster(w http.ResponseWriter, op *operation, workingDir, hostKubeconfig, clusterName string, params ClusterParams) ([]byte, bool) {
+	ctx := op.setStage("kubeconfig")
+	if err := fetchAndPatchKubeconfigFromSecret(ctx, workingDir, clusterName, hostKubeconfig, params); err != nil {
+		op.fail(w, fmt.Sprintf("Error fetching kubeconfig from secret: %v", err), http.StatusInternalServerError)
+		return nil, false
 	}
 
 	kcPath := filepath.Join(workingDir, ".vcluster", clusterName, "kubeconfig.yaml")
 	kcData, err := os.ReadFile(kcPath)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading kubeconfig: %v", err), http.StatusInternalServerError)
-		return
+		op.fail(w, fmt.Sprintf("Error reading kubeconfig: %v", err), http.StatusInternalServerError)
+		return nil, false
 	}
-	// Set cluster owner annotation after cluster is created
-	if err := setClusterOwner(hostKubeconfig, clusterName, currentUser); err != nil {
-		log.Printf("Warning: failed to set cluster owner: %v", err)
+	ctx = op.setStage("ready")
+	if err := waitForReadyz(ctx, hostKubeconfig, clusterName); err != nil {
+		op.fail(w, fmt.Sprintf("Virtual API server not ready: %v", err), http.StatusInternalServerError)
+		return nil, false
 	}
+	logger(ctx).Info("cluster ready", "cluster", clusterName, "since_start_s", time.Since(op.start).Seconds())
+	op.onFailure(nil)
+	return kcData, true
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:  "reqid",
-		Value: reqID,
-		Path:  "/",
+// armCreateRollback makes a cancelled create remove the cluster from here on,
+// and a failed one be kept or removed according to failedClusters.policy.
+func armCreateRollback(op *operation, hostKubeconfig, clusterName string, uploaded bool) {
+	op.onCancel(func(ctx context.Context) error {
+		return rollbackCreate(ctx, hostKubeconfig, clusterName)
+	})
+	op.onFailure(func(ctx context.Context, stage, msg string) string {
+		return handleFailedCreate(ctx, hostKubeconfig, clusterName, stage, msg, uploaded)
 	})
-	// Set cluster owner annotation after cluster is created
-	if err := setClusterOwner(hostKubeconfig, clusterName, currentUser); err != nil {
-		log.Printf("Warning: failed to set cluster owner: %v", err)
+}
+
+// deliverCluster fetches the kubeconfig of a cluster whose control plane is
+// up, waits for its API server and answers the create with a credential for
+// the owner.
+func deliverCluster(w http.ResponseWriter, op *operation, workingDir, hostKubeconfig, clusterName, currentUser string, params ClusterParams) {
+	kcData, ok := verifyCluster(w, op, workingDir, hostKubeconfig, clusterName, params)
+	if !ok {
+		return
+	}
+
+	// Hand out a scoped, expiring credential rather than the admin kubeconfig.
+	ctx := op.setStage("credential")
+	cred, minted, err := issueCredential(ctx, hostKubeconfig, clusterName, kcData, currentUser, RoleAdmin, currentConfig().Credentials.DefaultTTL.Duration)
+	if err != nil {
+		op.fail(w, fmt.Sprintf("Cluster created but issuing a credential failed, retry via /api/vcluster/%s/kubeconfig: %v", clusterName, err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("X-Kubehatch-Credential-Id", cred.ID)
+	w.Header().Set("X-Kubehatch-Expires-At", cred.ExpiresAt.Format(time.RFC3339))
+
+	// The kubeconfig is in the response, so a create does not fail for want of
+	// a download link.
+	downloadURL, _, err := storeDownload(ctx, clusterName, currentUser, fmt.Sprintf("kubeconfig-%s.yaml", clusterName), minted)
+	if err != nil {
+		logger(ctx).Warn("storing download failed", "cluster", clusterName, "err", err)
 	}
 
 	resp := VclusterResponse{
-		Kubeconfig: string(kcData),
+		ClusterName: clusterName,
+		Kubeconfig:  string(minted),
+		ExpiresAt:   cred.ExpiresAt,
+		DownloadURL: downloadURL,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// setClusterOwner sets the owner annotation on the namespace
-func setClusterOwner(hostKubeconfig, clusterName, owner string) error {
+// errClusterExists is returned when the namespace for a new cluster exists.
+var errClusterExists = errors.New("cluster already exists")
+
+// createClusterNamespace creates the vcluster-<name> namespace with the owner
+// and parameter annotations, plus any given ones, before anything is
+// installed, so that a cluster is never visible without its owner, even if the
+// create fails half way.
+func createClusterNamespace(ctx context.Context, hostKubeconfig, clusterName, owner string, params ClusterParams, annotations map[string]string) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cluster parameters: %v", err)
+	}
+	all := map[string]string{
+		"kubehatch.io/owner":  owner,
+		"kubehatch.io/params": string(data),
+	}
+	for k, v := range annotations {
+		all[k] = v
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":        "vcluster-" + clusterName,
+			"annotations": all,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	args := []string{"create", "-f", "-"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = bytes.NewReader(manifest)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		if strings.Contains(string(out), "AlreadyExists") {
+			return errClusterExists
+		}
+		return fmt.Errorf("failed to create namespace: %v, output: %s", err, string(out))
+	}
+	logger(ctx).Info("set cluster owner", "cluster", clusterName, "owner", owner)
+	return nil
+}
+
+// setClusterParams stores the creation parameters as a namespace annotation so
+// that later updates can re-render the same config.
+func setClusterParams(ctx context.Context, hostKubeconfig, clusterName string, params ClusterParams) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cluster parameters: %v", err)
+	}
 	namespace := "vcluster-" + clusterName
-	args := []string{"annotate", "namespace", namespace, fmt.Sprintf("kubehatch.io/owner=%s", owner), "--overwrite"}
+	args := []string{"annotate", "namespace", namespace, fmt.Sprintf("kubehatch.io/params=%s", string(data)), "--overwrite"}
 	if hostKubeconfig != "" {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to set owner annotation: %v, output: %s", err, string(out))
+		return fmt.Errorf("failed to set params annotation: %v, output: %s", err, string(out))
 	}
-	log.Printf("Set cluster %s owner to %s", clusterName, owner)
 	return nil
 }
 
+// readClusterParams reads the stored creation parameters. The boolean is
+// false for clusters created before parameters were stored.
+func readClusterParams(ctx context.Context, hostKubeconfig, clusterName string) (ClusterParams, bool, error) {
+	namespace := "vcluster-" + clusterName
+	args := []string{"get", "namespace", namespace, "-o", "jsonpath={.metadata.annotations.kubehatch\\.io/params}"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		return ClusterParams{}, false, fmt.Errorf("failed to get namespace %s: %v, output: %s", namespace, err, string(out))
+	}
+
+	params, ok := parseClusterParams(ctx, namespace, string(out))
+	return params, ok, nil
+}
+
+// parseClusterParams parses the params annotation of a namespace. The boolean
+// is false if it is missing or malformed.
+func parseClusterParams(ctx context.Context, namespace, raw string) (ClusterParams, bool) {
+	var params ClusterParams
+	if raw = strings.TrimSpace(raw); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &params); err == nil {
+			params.Exposure = params.ExposureMode()
+			return params, true
+		}
+		logger(ctx).Warn("ignoring malformed params annotation", "namespace", namespace)
+	}
+	return ClusterParams{}, false
+}
+
+// getClusterParams reads the stored creation parameters. Clusters created
+// before parameters were stored fall back to what is observed on the host.
+func getClusterParams(ctx context.Context, hostKubeconfig, clusterName string) (ClusterParams, error) {
+	params, ok, err := readClusterParams(ctx, hostKubeconfig, clusterName)
+	if err != nil || ok {
+		return params, err
+	}
+
+	info, err := getVclusterInfo(ctx, hostKubeconfig, clusterName)
+	if err != nil {
+		return ClusterParams{}, err
+	}
+	params.HA = info.HA
+	params.LoadBalancer = info.LoadBalancer
+	params.Exposure = params.ExposureMode()
+	return params, nil
+}
+
+// canAccessCluster mirrors the ownership filter used when listing clusters.
+func canAccessCluster(currentUser, owner string) bool {
+	return isAdminUser(currentUser) || owner == "" || owner == currentUser
+}
+
+// isAdminUser reports whether the user sees and manages every cluster: one of
+// the configured admin users, or "default" when no authentication is in front
+// of the backend.
+func isAdminUser(currentUser string) bool {
+	return currentUser == "default" || currentConfig().isAdmin(currentUser)
+}
+
+// authorizeCluster writes a 403 and returns false if the requesting user may
+// not access the cluster's credentials or control plane.
+func authorizeCluster(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) bool {
+	ctx := r.Context()
+	currentUser := getUserFromRequest(r)
+	if !canAccessCluster(currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName)) {
+		logger(ctx).Warn("cluster access denied", "user", currentUser, "cluster", clusterName)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func vclusterDetailHandler(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/vcluster/")
 	parts := strings.Split(path, "/")
@@ -280,22 +676,79 @@ func vclusterDetailHandler(w http.ResponseWriter, r *http.Request) {
 	clusterName := parts[0]
 	hostKubeconfig := getDefaultKubeconfig()
 
-	if r.Method == http.MethodDelete {
+	if len(parts) >= 2 && parts[1] == "credentials" {
+		credentialID := ""
+		if len(parts) == 3 {
+			credentialID = parts[2]
+		}
+		credentialsHandler(w, r, clusterName, hostKubeconfig, credentialID)
+		return
+	}
+
+	if r.Method == http.MethodDelete && len(parts) == 1 {
 		deleteVclusterHandler(w, r, clusterName, hostKubeconfig)
 		return
 	}
 
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		getVclusterDetailHandler(w, r, clusterName, hostKubeconfig)
+		return
+	}
+
+	if r.Method == http.MethodPatch && len(parts) == 1 {
+		patchVclusterHandler(w, r, clusterName, hostKubeconfig)
+		return
+	}
+
 	if len(parts) == 2 && parts[1] == "kubeconfig" {
 		getKubeconfigHandler(w, r, clusterName, hostKubeconfig)
 		return
 	}
 
+	if len(parts) == 2 && parts[1] == "download-url" {
+		downloadURLHandler(w, r, clusterName, hostKubeconfig)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "token" {
+		execTokenHandler(w, r, clusterName, hostKubeconfig)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "logs" {
+		getLogsHandler(w, r, clusterName, hostKubeconfig)
+		return
+	}
+
 	http.Error(w, "Not found", http.StatusNotFound)
 }
 
 func deleteVclusterHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
-	log.Printf("Deleting vcluster: %s", clusterName)
+	ctx := r.Context()
+	w, done := auditAction(w, r, AuditDelete, clusterName, nil)
+	defer done()
+	op := startOperation(ctx, w, "delete", clusterName, getUserFromRequest(r))
+	defer op.finish(w)
+	if !op.lockCluster(w, ctx) {
+		return
+	}
+	op.persistTo(hostKubeconfig)
+	ctx = op.setStage("uninstall")
+	logger(ctx).Info("deleting cluster", "cluster", clusterName)
+
+	if out, err := uninstallVirtualCluster(ctx, hostKubeconfig, clusterName); err != nil {
+		logger(ctx).Error("deleting cluster failed", "cluster", clusterName, "err", err, "output", string(out))
+		op.fail(w, fmt.Sprintf("Error deleting vcluster: %v", err), http.StatusInternalServerError)
+		return
+	}
 
+	logger(ctx).Info("deleted cluster", "cluster", clusterName)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cluster deleted successfully"})
+}
+
+// uninstallVirtualCluster runs vcluster delete, removing the namespace too.
+func uninstallVirtualCluster(ctx context.Context, hostKubeconfig, clusterName string) ([]byte, error) {
 	args := []string{
 		"delete", clusterName,
 		"--delete-namespace",
@@ -307,30 +760,218 @@ func deleteVclusterHandler(w http.ResponseWriter, r *http.Request, clusterName,
 		env = append(env, "KUBECONFIG="+hostKubeconfig)
 	}
 	cmd.Env = env
+	return runCommand(ctx, cmd)
+}
+
+// rollbackCreate removes whatever a create left behind. vcluster delete fails
+// if the install never got as far as a release, so the namespace is then
+// deleted directly.
+func rollbackCreate(ctx context.Context, hostKubeconfig, clusterName string) error {
+	out, err := uninstallVirtualCluster(ctx, hostKubeconfig, clusterName)
+	if err == nil {
+		return nil
+	}
+	logger(ctx).Debug("vcluster delete failed during rollback, deleting the namespace", "cluster", clusterName, "err", err, "output", string(out))
+	args := []string{"delete", "namespace", "vcluster-" + clusterName, "--ignore-not-found"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	if out, err := runCommand(ctx, exec.Command("kubectl", args...)); err != nil {
+		return fmt.Errorf("deleting namespace: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// patchVclusterHandler switches a cluster between single-replica and HA and
+// changes its exposure by re-rendering its config and upgrading it. It runs
+// as an update operation, so it can be cancelled and is resumed after a
+// restart.
+func patchVclusterHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+	ctx := r.Context()
+	auditParams := map[string]interface{}{}
+	w, done := auditAction(w, r, AuditUpdate, clusterName, auditParams)
+	defer done()
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
 
-	out, err := cmd.CombinedOutput()
+	var req VclusterPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.HA != nil {
+		auditParams["ha"] = *req.HA
+	}
+	if req.LoadBalancer != nil {
+		auditParams["loadbalancer"] = *req.LoadBalancer
+	}
+	if req.Exposure != nil {
+		auditParams["exposure"] = *req.Exposure
+	}
+
+	op := startOperation(ctx, w, "update", clusterName, currentUser)
+	defer op.finish(w)
+	if !op.lockCluster(w, ctx) {
+		return
+	}
+	op.persistTo(hostKubeconfig)
+	ctx = op.ctx
+
+	previous, err := getClusterParams(ctx, hostKubeconfig, clusterName)
 	if err != nil {
-		log.Printf("Error deleting vcluster: %v, output: %s", err, string(out))
-		http.Error(w, fmt.Sprintf("Error deleting vcluster: %v", err), http.StatusInternalServerError)
+		op.fail(w, fmt.Sprintf("Error reading cluster parameters: %v", err), http.StatusNotFound)
+		return
+	}
+	params := previous
+	params.EmbeddedEtcd = params.embeddedEtcd()
+	if req.HA != nil {
+		params.HA = *req.HA
+	}
+	if req.Exposure != nil {
+		exposure, err := parseExposure(*req.Exposure, false)
+		if err != nil {
+			op.fail(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Exposure = exposure
+	} else if req.LoadBalancer != nil {
+		params.Exposure, _ = parseExposure("", *req.LoadBalancer)
+	}
+	params.LoadBalancer = params.Exposure == ExposureLoadBalancer
+	if params.Exposure == ExposureNodePort && (previous.ExposureMode() != ExposureNodePort || params.NodeAddress == "") {
+		ctx = op.setStage("node-address")
+		if params.NodeAddress, err = discoverNodeAddress(ctx, hostKubeconfig); err != nil {
+			op.fail(w, fmt.Sprintf("Error discovering node address: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	logger(ctx).Info("updating cluster", "cluster", clusterName, "user", currentUser, "ha", params.HA, "exposure", params.Exposure)
+	if !updateCluster(w, op, hostKubeconfig, clusterName, previous, params) {
 		return
 	}
 
-	log.Printf("Successfully deleted vcluster: %s", clusterName)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Cluster deleted successfully"})
+	info, err := getVclusterInfo(op.ctx, hostKubeconfig, clusterName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading cluster status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The StatefulSet may not have rolled yet; report what was requested.
+	info.HA = params.HA
+	info.LoadBalancer = params.LoadBalancer
+	info.Exposure = params.Exposure
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// updateCluster stores params on the cluster first, so that a resumed update
+// knows its target, and then upgrades the cluster to them. Until the upgrade
+// has taken effect, a cancel upgrades the cluster back to previous and a
+// failure restores the stored parameters.
+func updateCluster(w http.ResponseWriter, op *operation, hostKubeconfig, clusterName string, previous, params ClusterParams) bool {
+	ctx := op.setStage("render-config")
+	if err := setClusterParams(ctx, hostKubeconfig, clusterName, params); err != nil {
+		op.fail(w, fmt.Sprintf("Error storing cluster parameters: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	op.onCancel(func(ctx context.Context) error {
+		if err := upgradeCluster(ctx, hostKubeconfig, clusterName, previous); err != nil {
+			return err
+		}
+		return setClusterParams(ctx, hostKubeconfig, clusterName, previous)
+	})
+	op.onFailure(func(ctx context.Context, stage, msg string) string {
+		if err := setClusterParams(ctx, hostKubeconfig, clusterName, previous); err != nil {
+			return "restoring the previous parameters failed: " + err.Error()
+		}
+		return ""
+	})
+
+	ctx = op.setStage("upgrade")
+	if err := upgradeCluster(ctx, hostKubeconfig, clusterName, params); err != nil {
+		op.fail(w, fmt.Sprintf("Error updating virtual cluster: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if err := checkReplicas(ctx, hostKubeconfig, clusterName, controlPlaneReplicas(params)); err != nil {
+		op.fail(w, fmt.Sprintf("Error resizing virtual cluster: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	op.onCancel(nil)
+	op.onFailure(nil)
+
+	ctx = op.setStage("expose")
+	if params.Exposure == ExposureIngress {
+		if err := applyIngress(ctx, hostKubeconfig, clusterName); err != nil {
+			op.fail(w, fmt.Sprintf("Error exposing virtual cluster: %v", err), http.StatusInternalServerError)
+			return false
+		}
+	} else if err := deleteIngress(ctx, hostKubeconfig, clusterName); err != nil {
+		logger(ctx).Warn("deleting ingress failed", "cluster", clusterName, "err", err)
+	}
+	return true
+}
+
+// upgradeCluster renders the config for params in a working directory of its
+// own and upgrades the cluster to it.
+func upgradeCluster(ctx context.Context, hostKubeconfig, clusterName string, params ClusterParams) error {
+	workingDir := filepath.Join(".", "requests", strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
+		return fmt.Errorf("creating working directory: %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+	if err := createVclusterYAML(workingDir, clusterName, params); err != nil {
+		return err
+	}
+	return upgradeVirtualCluster(ctx, workingDir, clusterName, hostKubeconfig, params.LoadBalancer)
 }
 
 func getKubeconfigHandler(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
-	// Always use secret method and update endpoint
-	getKubeconfigFromSecret(w, r, clusterName, hostKubeconfig)
+	ctx := r.Context()
+	w, done := auditAction(w, r, AuditKubeconfig, clusterName, kubeconfigAuditParams(r))
+	defer done()
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
+
+	role, ttl, err := parseCredentialRequest(r, currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	opts, err := parseKubeconfigOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The admin kubeconfig is only used to locate the API server and to mint
+	// a scoped credential; it is never handed to the caller.
+	kcData, cred, err := buildUserKubeconfig(ctx, hostKubeconfig, clusterName, currentUser, role, ttl, opts)
+	if err != nil {
+		logger(ctx).Error("building kubeconfig failed", "cluster", clusterName, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if cred != nil {
+		w.Header().Set("X-Kubehatch-Credential-Id", cred.ID)
+		w.Header().Set("X-Kubehatch-Expires-At", cred.ExpiresAt.Format(time.RFC3339))
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=kubeconfig-%s.yaml", clusterName))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(kcData)
 }
 
 // Get kubeconfig from secret and update endpoint
-func getKubeconfigFromSecret(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+func getKubeconfigFromSecret(ctx context.Context, clusterName, hostKubeconfig string) ([]byte, error) {
 	namespace := "vcluster-" + clusterName
 
 	// Use vcluster connect --print to get a working kubeconfig (includes port-forwarding setup)
-	log.Printf("Getting kubeconfig for %s using vcluster connect", clusterName)
+	logger(ctx).Debug("getting kubeconfig using vcluster connect", "cluster", clusterName)
 	args := []string{"connect", clusterName, "--namespace", namespace, "--print"}
 	if hostKubeconfig != "" {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
@@ -342,36 +983,24 @@ func getKubeconfigFromSecret(w http.ResponseWriter, r *http.Request, clusterName
 	}
 	cmd.Env = env
 
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
-		log.Printf("Error getting kubeconfig via vcluster connect for %s: %v, output: %s", clusterName, err, string(out))
-		// Fallback to secret method
-		log.Printf("Falling back to secret method for %s", clusterName)
-		getKubeconfigFromSecretFallback(w, r, clusterName, hostKubeconfig)
-		return
+		// The output is not logged: it may hold a partial kubeconfig.
+		logger(ctx).Warn("vcluster connect failed, falling back to the secret", "cluster", clusterName, "err", err)
+		kubeconfigFallbacks.inc("connect")
+		return getKubeconfigFromSecretFallback(ctx, clusterName, hostKubeconfig)
 	}
 
-	kcData := out
-
-	// Check if LoadBalancer is enabled and update endpoint
-	useLoadBalancer := checkLoadBalancerEnabled(hostKubeconfig, clusterName)
-	if useLoadBalancer {
-		endpoint, err := getExternalEndpoint(hostKubeconfig, clusterName)
-		if err == nil && endpoint != "" {
-			kcData, err = updateKubeconfigEndpoint(kcData, endpoint)
-			if err != nil {
-				log.Printf("Warning: failed to update kubeconfig endpoint: %v", err)
-			}
-		}
+	// Point the kubeconfig at the cluster's external endpoint, if exposed
+	params, ok, _ := readClusterParams(ctx, hostKubeconfig, clusterName)
+	if !ok {
+		params = ClusterParams{LoadBalancer: checkLoadBalancerEnabled(ctx, hostKubeconfig, clusterName)}
 	}
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=kubeconfig-%s.yaml", clusterName))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(kcData)
+	return patchExposureEndpoint(ctx, out, hostKubeconfig, clusterName, params, false), nil
 }
 
 // Fallback method using secret
-func getKubeconfigFromSecretFallback(w http.ResponseWriter, r *http.Request, clusterName, hostKubeconfig string) {
+func getKubeconfigFromSecretFallback(ctx context.Context, clusterName, hostKubeconfig string) ([]byte, error) {
 	namespace := "vcluster-" + clusterName
 	secretName := "vc-" + clusterName
 
@@ -380,37 +1009,32 @@ func getKubeconfigFromSecretFallback(w http.ResponseWriter, r *http.Request, clu
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
-		log.Printf("Error getting kubeconfig for %s: %v, output: %s", clusterName, err, string(out))
-		http.Error(w, fmt.Sprintf("Error getting kubeconfig: %v", err), http.StatusNotFound)
-		return
+		logger(ctx).Error("reading kubeconfig secret failed", "cluster", clusterName, "err", err, "output", string(out))
+		return nil, err
 	}
 
 	base64Data := strings.TrimSpace(string(out))
 	if base64Data == "" {
-		http.Error(w, "Kubeconfig secret is empty", http.StatusNotFound)
-		return
+		return nil, fmt.Errorf("kubeconfig secret is empty")
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(base64Data)
 	if err != nil {
-		log.Printf("Error decoding kubeconfig for %s: %v", clusterName, err)
-		http.Error(w, fmt.Sprintf("Error decoding kubeconfig: %v", err), http.StatusInternalServerError)
-		return
+		logger(ctx).Error("decoding kubeconfig secret failed", "cluster", clusterName, "err", err)
+		return nil, fmt.Errorf("error decoding kubeconfig: %v", err)
 	}
 
 	// For kind clusters, add note that port-forwarding is needed
 	// The kubeconfig will have localhost:8443 which requires port-forwarding
-	log.Printf("Note: For kind clusters, user needs to run 'vcluster connect %s -n %s' for port-forwarding", clusterName, namespace)
+	logger(ctx).Debug("kubeconfig from secret may need port-forwarding", "cluster", clusterName, "hint", fmt.Sprintf("vcluster connect %s -n %s", clusterName, namespace))
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=kubeconfig-%s.yaml", clusterName))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(decoded)
+	return decoded, nil
 }
 
 // Get ClusterIP service endpoint for vcluster
-func getClusterIPEndpoint(hostKubeconfig, clusterName string) (string, error) {
+func getClusterIPEndpoint(ctx context.Context, hostKubeconfig, clusterName string) (string, error) {
 	namespace := "vcluster-" + clusterName
 	svcName := clusterName
 
@@ -419,7 +1043,7 @@ func getClusterIPEndpoint(hostKubeconfig, clusterName string) (string, error) {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
 		return "", fmt.Errorf("failed to get service: %v", err)
 	}
@@ -435,7 +1059,7 @@ func getClusterIPEndpoint(hostKubeconfig, clusterName string) (string, error) {
 		clusterIPArgs = append([]string{"--kubeconfig", hostKubeconfig}, clusterIPArgs...)
 	}
 	clusterIPCmd := exec.Command("kubectl", clusterIPArgs...)
-	clusterIPOut, err := clusterIPCmd.CombinedOutput()
+	clusterIPOut, err := runCommand(ctx, clusterIPCmd)
 	if err != nil {
 		return "", fmt.Errorf("failed to get ClusterIP: %v", err)
 	}
@@ -461,6 +1085,7 @@ func getClusterIPEndpoint(hostKubeconfig, clusterName string) (string, error) {
 }
 
 func vclustersListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
 		return
@@ -468,7 +1093,7 @@ func vclustersListHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get current user for filtering
 	currentUser := getUserFromRequest(r)
-	log.Printf("Listing clusters for user: %s", currentUser)
+	logger(ctx).Debug("listing clusters", "user", currentUser)
 
 	hostKubeconfig := getDefaultKubeconfig()
 	if hostKubeconfig == "" {
@@ -478,29 +1103,29 @@ func vclustersListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clusters, err := listVclusters(hostKubeconfig, currentUser)
+	clusters, err := listVclusters(ctx, hostKubeconfig, currentUser)
 	if err != nil {
-		log.Printf("Error listing vclusters: %v", err)
-		log.Printf("Using kubeconfig: %s", hostKubeconfig)
+		logger(ctx).Error("listing clusters failed", "err", err)
 		// Return empty list on error rather than failing
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode([]VclusterInfo{})
 		return
 	}
-	log.Printf("Found %d vclusters for user %s", len(clusters), currentUser)
+	logger(ctx).Debug("listed clusters", "user", currentUser, "count", len(clusters))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(clusters)
 }
 
-func listVclusters(hostKubeconfig, currentUser string) ([]VclusterInfo, error) {
+// listVclusterNamespaces returns all host namespaces that hold a vcluster.
+func listVclusterNamespaces(ctx context.Context, hostKubeconfig string) ([]NamespaceJSON, error) {
 	// List all namespaces that start with "vcluster-"
 	args := []string{"get", "namespaces", "-o", "json"}
 	if hostKubeconfig != "" {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list namespaces: %v", err)
 	}
@@ -512,43 +1137,51 @@ func listVclusters(hostKubeconfig, currentUser string) ([]VclusterInfo, error) {
 		return nil, fmt.Errorf("failed to parse namespace list: %v", err)
 	}
 
-	var clusters []VclusterInfo
-	log.Printf("Processing %d namespaces", len(namespaceList.Items))
+	var namespaces []NamespaceJSON
 	for _, ns := range namespaceList.Items {
-		if !strings.HasPrefix(ns.Metadata.Name, "vcluster-") {
-			continue
+		if strings.HasPrefix(ns.Metadata.Name, "vcluster-") {
+			namespaces = append(namespaces, ns)
 		}
+	}
+	return namespaces, nil
+}
 
-		clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
-		log.Printf("Processing cluster: %s (namespace: %s)", clusterName, ns.Metadata.Name)
-		info, err := getVclusterInfo(hostKubeconfig, clusterName, ns.Metadata.CreationTimestamp, currentUser)
-		if err != nil {
-			log.Printf("Error getting info for cluster %s: %v", clusterName, err)
-			// Still add basic info even if detailed info fails
-			info = VclusterInfo{
-				Name:      clusterName,
-				Namespace: ns.Metadata.Name,
-				CreatedAt: ns.Metadata.CreationTimestamp,
-				Status:    "Unknown",
-				Owner:     getClusterOwner(hostKubeconfig, clusterName), // Try to get owner
-			}
-		}
+// listConcurrency bounds the clusters inspected at once when listing.
+const listConcurrency = 8
 
-		// Filter: Only show clusters owned by current user (or all if user is "default" or "admin")
-		if currentUser == "default" || currentUser == "admin" || info.Owner == "" || info.Owner == currentUser {
-			clusters = append(clusters, info)
-			log.Printf("Added cluster %s to list (status: %s, owner: %s)", clusterName, info.Status, info.Owner)
-		} else {
-			log.Printf("Skipping cluster %s (owner: %s, current user: %s)", clusterName, info.Owner, currentUser)
-		}
+func listVclusters(ctx context.Context, hostKubeconfig, currentUser string) ([]VclusterInfo, error) {
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("Returning %d clusters", len(clusters))
+	// Filter: Only show clusters owned by current user (or all for admin users)
+	var visible []NamespaceJSON
+	for _, ns := range namespaces {
+		if canAccessCluster(currentUser, ns.Metadata.Annotations["kubehatch.io/owner"]) {
+			visible = append(visible, ns)
+		}
+	}
+	logger(ctx).Debug("processing namespaces", "count", len(visible))
+
+	clusters := make([]VclusterInfo, len(visible))
+	sem := make(chan struct{}, listConcurrency)
+	var wg sync.WaitGroup
+	for i, ns := range visible {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			clusters[i] = vclusterInfo(ctx, hostKubeconfig, ns, false)
+		}()
+	}
+	wg.Wait()
 	return clusters, nil
 }
 
 // getClusterOwner tries to determine cluster owner from namespace or annotations
-func getClusterOwner(hostKubeconfig, clusterName string) string {
+func getClusterOwner(ctx context.Context, hostKubeconfig, clusterName string) string {
 	namespace := "vcluster-" + clusterName
 	// Try to get owner from namespace annotation
 	args := []string{"get", "namespace", namespace, "-o", "jsonpath={.metadata.annotations.kubehatch\\.io/owner}"}
@@ -556,104 +1189,96 @@ func getClusterOwner(hostKubeconfig, clusterName string) string {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err == nil && strings.TrimSpace(string(out)) != "" {
 		return strings.TrimSpace(string(out))
 	}
-	// If namespace starts with vcluster-<user>-, extract user
-	if strings.HasPrefix(namespace, "vcluster-") {
-		parts := strings.Split(strings.TrimPrefix(namespace, "vcluster-"), "-")
-		if len(parts) > 1 {
-			// Check if it's user-prefixed format: vcluster-<user>-<cluster>
-			// For now, assume standard format unless we detect user prefix
-			return ""
-		}
-	}
 	return ""
 }
 
-func getVclusterInfo(hostKubeconfig, clusterName string, createdAt time.Time, currentUser string) (VclusterInfo, error) {
-	namespace := "vcluster-" + clusterName
-	info := VclusterInfo{
-		Name:      clusterName,
-		Namespace: namespace,
-		CreatedAt: createdAt,
-		Status:    "Unknown",
-		Owner:     getClusterOwner(hostKubeconfig, clusterName),
-	}
-
-	// Check if StatefulSet exists to determine HA
-	args := []string{"get", "statefulset", clusterName, "-n", namespace, "-o", "json"}
-	if hostKubeconfig != "" {
-		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
-	}
-	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+// getVclusterInfo describes a cluster, including a live /readyz probe.
+func getVclusterInfo(ctx context.Context, hostKubeconfig, clusterName string) (VclusterInfo, error) {
+	ns, err := getClusterNamespace(ctx, hostKubeconfig, clusterName)
 	if err != nil {
-		// StatefulSet might not exist yet, try to get status from namespace
-		info.Status = "Pending"
-		return info, nil
+		return VclusterInfo{}, err
 	}
+	return vclusterInfo(ctx, hostKubeconfig, ns, true), nil
+}
 
-	var sts StatefulSetJSON
-	if err := json.Unmarshal(out, &sts); err == nil {
-		info.HA = sts.Spec.Replicas > 1
-		if sts.Status.ReadyReplicas == sts.Spec.Replicas && sts.Spec.Replicas > 0 {
-			info.Status = "Running"
-		} else if sts.Status.ReadyReplicas > 0 {
-			info.Status = "Pending"
-		} else {
-			info.Status = "Pending"
-		}
-	}
+// vclusterInfo describes the cluster in the namespace ns. With probe set, the
+// virtual API server's /readyz is probed as well.
+func vclusterInfo(ctx context.Context, hostKubeconfig string, ns NamespaceJSON, probe bool) VclusterInfo {
+	clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+	res, resErr := getClusterResources(ctx, hostKubeconfig, clusterName)
+	return clusterInfo(ctx, hostKubeconfig, ns, res, resErr, probe)
+}
 
-	// Check for LoadBalancer service
-	svcArgs := []string{"get", "svc", clusterName, "-n", namespace, "-o", "json"}
-	if hostKubeconfig != "" {
-		svcArgs = append([]string{"--kubeconfig", hostKubeconfig}, svcArgs...)
-	}
-	svcCmd := exec.Command("kubectl", svcArgs...)
-	svcOut, err := svcCmd.CombinedOutput()
-	if err == nil {
-		var svc ServiceJSON
-		if err := json.Unmarshal(svcOut, &svc); err == nil {
-			if svc.Spec.Ports != nil && len(svc.Spec.Ports) > 0 {
-				// Check if it's a LoadBalancer type by checking the service type
-				typeArgs := []string{"get", "svc", clusterName, "-n", namespace, "-o", "jsonpath={.spec.type}"}
-				if hostKubeconfig != "" {
-					typeArgs = append([]string{"--kubeconfig", hostKubeconfig}, typeArgs...)
-				}
-				typeCmd := exec.Command("kubectl", typeArgs...)
-				typeOut, _ := typeCmd.CombinedOutput()
-				if strings.TrimSpace(string(typeOut)) == "LoadBalancer" {
-					info.LoadBalancer = true
-					endpoint, err := getExternalEndpoint(hostKubeconfig, clusterName)
-					if err == nil {
-						info.Endpoint = endpoint
-					}
-				}
+// clusterInfo builds the VclusterInfo of a namespace from its already
+// fetched resources.
+func clusterInfo(ctx context.Context, hostKubeconfig string, ns NamespaceJSON, res clusterResources, resErr error, probe bool) VclusterInfo {
+	clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+	info := VclusterInfo{
+		Name:      clusterName,
+		Namespace: ns.Metadata.Name,
+		CreatedAt: ns.Metadata.CreationTimestamp,
+		Status:    StatusUnknown,
+		Owner:     ns.Metadata.Annotations["kubehatch.io/owner"],
+	}
+	if resErr != nil {
+		logger(ctx).Warn("getting cluster resources failed", "cluster", clusterName, "err", resErr)
+	}
+	if res.sts != nil {
+		info.HA = res.sts.Spec.Replicas > 1
+	}
+	if res.svc != nil && res.svc.Spec.Type == "LoadBalancer" && len(res.svc.Spec.Ports) > 0 {
+		info.LoadBalancer = true
+		info.Endpoint, _ = serviceEndpoint(*res.svc)
+	}
+
+	info.Exposure = ExposureNone
+	if info.LoadBalancer {
+		info.Exposure = ExposureLoadBalancer
+	}
+	if params, ok := parseClusterParams(ctx, ns.Metadata.Name, ns.Metadata.Annotations["kubehatch.io/params"]); ok {
+		switch params.ExposureMode() {
+		case ExposureIngress:
+			info.Exposure = ExposureIngress
+			info.Endpoint = "https://" + ingressHost(clusterName)
+		case ExposureNodePort:
+			info.Exposure = ExposureNodePort
+			if res.svc != nil {
+				info.Endpoint, _ = nodePortEndpoint(*res.svc, clusterName, params.NodeAddress)
 			}
 		}
 	}
 
-	return info, nil
+	info.Conditions, info.Status, info.Reason, info.Message = assessHealth(ctx, hostKubeconfig, clusterName, res, resErr, info.LoadBalancer, info.Endpoint, probe)
+	if failure, ok := clusterFailure(ns.Metadata.Annotations); ok {
+		info.Status, info.Reason = StatusFailed, "CreateFailed"
+		info.Message = fmt.Sprintf("create failed at stage %s: %s", failure.Stage, failure.Message)
+		info.FailedStage = failure.Stage
+		if !failure.DeleteAfter.IsZero() {
+			info.DeleteAfter = &failure.DeleteAfter
+		}
+	}
+	return info
 }
 
-func checkLoadBalancerEnabled(hostKubeconfig, clusterName string) bool {
+func checkLoadBalancerEnabled(ctx context.Context, hostKubeconfig, clusterName string) bool {
 	namespace := "vcluster-" + clusterName
 	args := []string{"get", "svc", clusterName, "-n", namespace, "-o", "jsonpath={.spec.type}"}
 	if hostKubeconfig != "" {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
 		return false
 	}
 	return strings.TrimSpace(string(out)) == "LoadBalancer"
 }
 
-func getExternalEndpoint(hostKubeconfig, clusterName string) (string, error) {
+func getExternalEndpoint(ctx context.Context, hostKubeconfig, clusterName string) (string, error) {
 	namespace := "vcluster-" + clusterName
 	svcName := clusterName
 
@@ -662,7 +1287,7 @@ func getExternalEndpoint(hostKubeconfig, clusterName string) (string, error) {
 		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 	}
 	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
 		return "", fmt.Errorf("failed to get service: %v", err)
 	}
@@ -671,7 +1296,12 @@ func getExternalEndpoint(hostKubeconfig, clusterName string) (string, error) {
 	if err := json.Unmarshal(out, &svc); err != nil {
 		return "", fmt.Errorf("failed to parse service: %v", err)
 	}
+	return serviceEndpoint(svc)
+}
 
+// serviceEndpoint returns the URL of a LoadBalancer service's external
+// address.
+func serviceEndpoint(svc ServiceJSON) (string, error) {
 	if len(svc.Status.LoadBalancer.Ingress) == 0 {
 		return "", fmt.Errorf("no external endpoint available")
 	}
@@ -701,26 +1331,9 @@ func getExternalEndpoint(hostKubeconfig, clusterName string) (string, error) {
 	return endpoint, nil
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("reqid")
-	if err != nil {
-		http.Error(w, "Request ID not set", http.StatusBadRequest)
-		return
-	}
-	clusterName := r.URL.Query().Get("clusterName")
-	if clusterName == "" {
-		http.Error(w, "clusterName query parameter required", http.StatusBadRequest)
-		return
-	}
-	kcPath := filepath.Join(".", "requests", cookie.Value, ".vcluster", clusterName, "kubeconfig.yaml")
-	w.Header().Set("Content-Disposition", "attachment; filename=kubeconfig.yaml")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, kcPath)
-}
-
 func getDefaultKubeconfig() string {
 	// First try the mounted secret path (for Kubernetes deployment)
-	defaultPath := "/var/secrets/kubeconfig"
+	defaultPath := currentConfig().HostKubeconfig
 	if _, err := os.Stat(defaultPath); err == nil {
 		return defaultPath
 	}
@@ -736,20 +1349,20 @@ func getDefaultKubeconfig() string {
 	return ""
 }
 
-func createVclusterYAML(workingDir, clusterName string, ha, useLoadBalancer bool) error {
-	cfg := VclusterConfig{
-		APIVersion: "v1",
-		Kind:       "VirtualCluster",
-	}
-	cfg.Metadata.Name = clusterName
-	if ha {
-		cfg.Spec.Replicas = 3
-	} else {
-		cfg.Spec.Replicas = 1
-	}
-	if useLoadBalancer {
-		cfg.Spec.Service.Type = "LoadBalancer"
-	}
+func createVclusterYAML(workingDir, clusterName string, params ClusterParams) error {
+	var cfg VclusterConfig
+	cfg.ControlPlane.StatefulSet.HighAvailability.Replicas = controlPlaneReplicas(params)
+	cfg.ControlPlane.BackingStore.Etcd.Embedded.Enabled = params.embeddedEtcd()
+	switch params.ExposureMode() {
+	case ExposureLoadBalancer:
+		cfg.ControlPlane.Service.Spec.Type = "LoadBalancer"
+	case ExposureNodePort:
+		cfg.ControlPlane.Service.Spec.Type = "NodePort"
+	default:
+		// Explicit so that an upgrade turns an existing LoadBalancer off.
+		cfg.ControlPlane.Service.Spec.Type = "ClusterIP"
+	}
+	cfg.ControlPlane.Proxy.ExtraSANs = tlsSANs(clusterName, params)
 	data, err := yaml.Marshal(&cfg)
 	if err != nil {
 		return fmt.Errorf("error marshalling YAML: %v", err)
@@ -758,21 +1371,39 @@ func createVclusterYAML(workingDir, clusterName string, ha, useLoadBalancer bool
 	if err := os.WriteFile(yamlPath, data, 0644); err != nil {
 		return fmt.Errorf("error writing vcluster.yaml: %v", err)
 	}
-	log.Println("Generated vcluster.yaml:")
-	log.Println(string(data))
 	return nil
 }
 
-func getFreePort() (int, error) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+// controlPlaneReplicas returns the number of control-plane pods for params.
+func controlPlaneReplicas(params ClusterParams) int {
+	if params.HA {
+		return currentConfig().HAReplicas
+	}
+	return 1
+}
+
+// checkReplicas returns an error unless the control-plane StatefulSet asks
+// for want pods.
+func checkReplicas(ctx context.Context, hostKubeconfig, clusterName string, want int) error {
+	args := []string{"get", "statefulset", clusterName, "-n", "vcluster-" + clusterName, "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommandOutput(ctx, exec.Command("kubectl", args...))
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("reading control plane StatefulSet: %v", err)
+	}
+	var sts StatefulSetJSON
+	if err := json.Unmarshal(out, &sts); err != nil {
+		return fmt.Errorf("parsing control plane StatefulSet: %v", err)
+	}
+	if sts.Spec.Replicas != want {
+		return fmt.Errorf("control plane has %d replicas after the upgrade, want %d", sts.Spec.Replicas, want)
 	}
-	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port, nil
+	return nil
 }
 
-func createVirtualCluster(workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
+func createVirtualCluster(ctx context.Context, workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
 	args := []string{
 		"create", clusterName,
 		"--config", "vcluster.yaml",
@@ -789,31 +1420,59 @@ func createVirtualCluster(workingDir, clusterName, hostKubeconfig string, useLoa
 		env = append(env, "KUBECONFIG="+hostKubeconfig)
 	}
 	cmd.Env = env
-	log.Printf("DEBUG: executing vcluster command: vcluster %s (in %s)", strings.Join(args, " "), workingDir)
-	log.Printf("DEBUG: Full command args: %v", cmd.Args)
-	out, err := cmd.CombinedOutput()
+	logger(ctx).Info("creating virtual cluster", "cluster", clusterName, "expose", useLoadBalancer)
+	out, err := runCommand(ctx, cmd)
 	if err != nil {
-		log.Printf("DEBUG: vcluster create command output:\n%s", string(out))
+		logger(ctx).Error("vcluster create failed", "cluster", clusterName, "err", err, "output", string(out))
 		return fmt.Errorf("vcluster create failed: %v\nOutput:\n%s", err, string(out))
 	}
-	log.Println("DEBUG: vcluster create command finished, output:")
-	log.Println(string(out))
+	logger(ctx).Debug("vcluster create finished", "cluster", clusterName, "output", string(out))
 	return nil
 }
 
-func fetchAndPatchKubeconfigFromSecret(workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
+// upgradeVirtualCluster applies a re-rendered vcluster.yaml to an existing cluster.
+func upgradeVirtualCluster(ctx context.Context, workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
+	args := []string{
+		"create", clusterName,
+		"--namespace", "vcluster-" + clusterName,
+		"--config", "vcluster.yaml",
+		"--upgrade",
+		"--connect=false",
+	}
+	if useLoadBalancer {
+		args = append(args, "--expose")
+	}
+	cmd := exec.Command("vcluster", args...)
+	cmd.Dir = workingDir
+	env := filterEnv(os.Environ(), []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT", "KUBERNETES_PORT"})
+	if hostKubeconfig != "" {
+		env = append(env, "KUBECONFIG="+hostKubeconfig)
+	}
+	cmd.Env = env
+	logger(ctx).Info("upgrading virtual cluster", "cluster", clusterName, "expose", useLoadBalancer)
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("vcluster upgrade failed: %v\nOutput:\n%s", err, string(out))
+	}
+	logger(ctx).Debug("vcluster upgrade finished", "cluster", clusterName, "output", string(out))
+	return nil
+}
+
+func fetchAndPatchKubeconfigFromSecret(ctx context.Context, workingDir, clusterName, hostKubeconfig string, params ClusterParams) error {
 	namespace := "vcluster-" + clusterName
 
 	// For kind clusters, use vcluster connect --print to get a working kubeconfig
 	// This includes the proper port-forwarding setup
-	log.Printf("DEBUG: Getting kubeconfig using vcluster connect for %s", clusterName)
+	logger(ctx).Debug("getting kubeconfig using vcluster connect", "cluster", clusterName)
 
-	retryTimeout := time.After(3 * time.Minute)
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	retryTimeout := time.After(currentConfig().Timeouts.ConnectRetry.Duration)
+	backoff := minReadyBackoff
 
+	connectCtx, connectSpan := startSpan(ctx, "vcluster connect retries", spanKindInternal, attrString("kubehatch.cluster", clusterName))
+	attempts := 0
 	var kcData []byte
 	for {
+		attempts++
 		args := []string{"connect", clusterName, "--namespace", namespace, "--print"}
 		if hostKubeconfig != "" {
 			args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
@@ -825,121 +1484,60 @@ func fetchAndPatchKubeconfigFromSecret(workingDir, clusterName, hostKubeconfig s
 		}
 		cmd.Env = env
 
-		out, err := cmd.CombinedOutput()
+		out, err := runCommand(connectCtx, cmd)
 		if err != nil {
-			log.Printf("DEBUG: vcluster connect failed (cluster may not be ready): %v", err)
+			logger(ctx).Debug("vcluster connect failed, cluster may not be ready", "cluster", clusterName, "attempt", attempts, "err", err)
 		} else {
 			kcData = out
-			log.Printf("DEBUG: successfully retrieved kubeconfig using vcluster connect")
+			logger(ctx).Debug("retrieved kubeconfig using vcluster connect", "cluster", clusterName, "attempts", attempts)
 			break
 		}
 
 		select {
+		case <-ctx.Done():
+			connectSpan.End()
+			return ctx.Err()
 		case <-retryTimeout:
 			// Fallback to secret method
-			log.Printf("DEBUG: vcluster connect timed out, falling back to secret method")
-			return fetchKubeconfigFromSecretFallback(workingDir, clusterName, hostKubeconfig, useLoadBalancer)
-		case <-ticker.C:
-			log.Println("DEBUG: vcluster not ready yet, retrying connect...")
-		}
-	}
-
-	// If LoadBalancer is enabled, try to update endpoint
-	if useLoadBalancer {
-		log.Println("DEBUG: polling for external endpoint of virtual cluster...")
-		externalEndpoint, err := pollForExternalEndpoint(hostKubeconfig, clusterName)
-		if err == nil && externalEndpoint != "" {
-			kcData, err = updateKubeconfigEndpoint(kcData, externalEndpoint)
-			if err != nil {
-				log.Printf("Warning: failed to update kubeconfig endpoint: %v", err)
-			}
+			kubeconfigFallbacks.inc("create")
+			connectSpan.SetAttributes(attrInt("kubehatch.attempts", attempts), attrBool("kubehatch.fallback", true))
+			connectSpan.End()
+			logger(ctx).Warn("vcluster connect timed out, falling back to the secret", "cluster", clusterName, "attempts", attempts)
+			return fetchKubeconfigFromSecretFallback(ctx, workingDir, clusterName, hostKubeconfig, params)
+		case <-time.After(backoff):
+			// not ready yet, retry
 		}
+		backoff = nextReadyBackoff(backoff)
 	}
 
-	newDir := filepath.Join(workingDir, ".vcluster", clusterName)
-	newPath := filepath.Join(newDir, "kubeconfig.yaml")
-	if err := os.MkdirAll(newDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
-	}
-	if err := os.WriteFile(newPath, kcData, 0644); err != nil {
-		return fmt.Errorf("failed to write kubeconfig file: %v", err)
-	}
-	log.Println("DEBUG: kubeconfig written to", newPath)
-	return nil
-}
-
-// Fallback method to get kubeconfig from secret
-func fetchKubeconfigFromSecretFallback(workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
-	namespace := "vcluster-" + clusterName
-	secretName := "vc-" + clusterName
-	var kcData []byte
+	connectSpan.SetAttributes(attrInt("kubehatch.attempts", attempts))
+	connectSpan.End()
 
-	retryTimeout := time.After(2 * time.Minute)
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-	for {
-		args := []string{"get", "secret", secretName, "-n", namespace, "--template={{.data.config}}"}
-		if hostKubeconfig != "" {
-			args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
-		}
-		cmd := exec.Command("kubectl", args...)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("DEBUG: failed to get secret %s in namespace %s: %v, output: %s", secretName, namespace, err, string(out))
-		} else {
-			base64Data := strings.TrimSpace(string(out))
-			if base64Data == "" {
-				log.Printf("DEBUG: secret %s exists but data is empty, retrying...", secretName)
-			} else {
-				decoded, err := base64.StdEncoding.DecodeString(base64Data)
-				if err != nil {
-					log.Printf("DEBUG: failed to decode base64 kubeconfig: %v", err)
-				} else if len(decoded) > 0 {
-					kcData = decoded
-					log.Printf("DEBUG: successfully retrieved kubeconfig from secret %s", secretName)
-					break
-				}
-			}
-		}
-		select {
-		case <-retryTimeout:
-			return fmt.Errorf("timed out waiting for vcluster secret %s in namespace %s", secretName, namespace)
-		case <-ticker.C:
-			log.Println("DEBUG: secret not ready yet, retrying...")
-		}
-	}
-
-	if useLoadBalancer {
-		log.Println("DEBUG: polling for external endpoint of virtual cluster...")
-		externalEndpoint, err := pollForExternalEndpoint(hostKubeconfig, clusterName)
-		if err == nil && externalEndpoint != "" {
-			kcData, err = updateKubeconfigEndpoint(kcData, externalEndpoint)
-			if err != nil {
-				log.Printf("Warning: failed to update kubeconfig endpoint: %v", err)
-			}
-		}
+	// If the cluster is exposed, try to update endpoint
+	if params.ExposureMode() == ExposureLoadBalancer {
+		logger(ctx).Info("polling for external endpoint", "cluster", clusterName)
 	}
+	kcData = patchExposureEndpoint(ctx, kcData, hostKubeconfig, clusterName, params, true)
 
 	newDir := filepath.Join(workingDir, ".vcluster", clusterName)
 	newPath := filepath.Join(newDir, "kubeconfig.yaml")
-	if err := os.MkdirAll(newDir, 0755); err != nil {
+	if err := os.MkdirAll(newDir, 0700); err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
-	if err := os.WriteFile(newPath, kcData, 0644); err != nil {
+	if err := os.WriteFile(newPath, kcData, 0600); err != nil {
 		return fmt.Errorf("failed to write kubeconfig file: %v", err)
 	}
-	log.Println("DEBUG: kubeconfig written to", newPath)
+	logger(ctx).Debug("kubeconfig written", "cluster", clusterName)
 	return nil
 }
 
-// Old function name kept for compatibility
-func fetchKubeconfigFromSecret(workingDir, clusterName, hostKubeconfig string, useLoadBalancer bool) error {
-	return fetchKubeconfigFromSecretFallback(workingDir, clusterName, hostKubeconfig, useLoadBalancer)
+// Fallback method to get kubeconfig from secret
+func fetchKubeconfigFromSecretFallback(ctx context.Context, workingDir, clusterName, hostKubeconfig string, params ClusterParams) error {
 	namespace := "vcluster-" + clusterName
 	secretName := "vc-" + clusterName
 	var kcData []byte
 
-	retryTimeout := time.After(2 * time.Minute)
+	retryTimeout := time.After(currentConfig().Timeouts.SecretRetry.Duration)
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
 	for {
@@ -948,75 +1546,75 @@ func fetchKubeconfigFromSecret(workingDir, clusterName, hostKubeconfig string, u
 			args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
 		}
 		cmd := exec.Command("kubectl", args...)
-		out, err := cmd.CombinedOutput()
+		out, err := runCommand(ctx, cmd)
 		if err != nil {
-			log.Printf("DEBUG: failed to get secret %s in namespace %s: %v, output: %s", secretName, namespace, err, string(out))
+			logger(ctx).Debug("reading kubeconfig secret failed", "cluster", clusterName, "secret", secretName, "err", err, "output", string(out))
 		} else {
 			base64Data := strings.TrimSpace(string(out))
 			if base64Data == "" {
-				log.Printf("DEBUG: secret %s exists but data is empty, retrying...", secretName)
+				logger(ctx).Debug("kubeconfig secret is empty, retrying", "cluster", clusterName, "secret", secretName)
 			} else {
 				decoded, err := base64.StdEncoding.DecodeString(base64Data)
 				if err != nil {
-					log.Printf("DEBUG: failed to decode base64 kubeconfig: %v", err)
+					logger(ctx).Debug("decoding kubeconfig secret failed", "cluster", clusterName, "err", err)
 				} else if len(decoded) > 0 {
 					kcData = decoded
-					log.Printf("DEBUG: successfully retrieved kubeconfig from secret %s", secretName)
+					logger(ctx).Debug("retrieved kubeconfig from secret", "cluster", clusterName, "secret", secretName)
 					break
 				}
 			}
 		}
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-retryTimeout:
 			return fmt.Errorf("timed out waiting for vcluster secret %s in namespace %s", secretName, namespace)
 		case <-ticker.C:
-			log.Println("DEBUG: secret not ready yet, retrying...")
+			// not ready yet, retry
 		}
 	}
 
-	if useLoadBalancer {
-		log.Println("DEBUG: polling for external endpoint of virtual cluster...")
-		externalEndpoint, err := pollForExternalEndpoint(hostKubeconfig, clusterName)
-		if err == nil && externalEndpoint != "" {
-			kcData, err = updateKubeconfigEndpoint(kcData, externalEndpoint)
-			if err != nil {
-				log.Printf("Warning: failed to update kubeconfig endpoint: %v", err)
-			}
-		}
+	if params.ExposureMode() == ExposureLoadBalancer {
+		logger(ctx).Info("polling for external endpoint", "cluster", clusterName)
 	}
+	kcData = patchExposureEndpoint(ctx, kcData, hostKubeconfig, clusterName, params, true)
 
 	newDir := filepath.Join(workingDir, ".vcluster", clusterName)
 	newPath := filepath.Join(newDir, "kubeconfig.yaml")
-	if err := os.MkdirAll(newDir, 0755); err != nil {
+	if err := os.MkdirAll(newDir, 0700); err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
-	if err := os.WriteFile(newPath, kcData, 0644); err != nil {
+	if err := os.WriteFile(newPath, kcData, 0600); err != nil {
 		return fmt.Errorf("failed to write kubeconfig file: %v", err)
 	}
-	log.Println("DEBUG: kubeconfig written to", newPath)
+	logger(ctx).Debug("kubeconfig written", "cluster", clusterName)
 	return nil
 }
 
-func pollForExternalEndpoint(hostKubeconfig, clusterName string) (string, error) {
+func pollForExternalEndpoint(ctx context.Context, hostKubeconfig, clusterName string) (string, error) {
+	ctx, span := startSpan(ctx, "poll external endpoint", spanKindInternal, attrString("kubehatch.cluster", clusterName))
+	defer span.End()
 	ns := "vcluster-" + clusterName
 	svcName := clusterName
-	timeout := time.After(3 * time.Minute)
+	timeout := time.After(currentConfig().Timeouts.LoadBalancer.Duration)
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
 		case <-timeout:
 			return "", fmt.Errorf("timed out waiting for external endpoint")
 		case <-ticker.C:
 			cmd := exec.Command("kubectl", "--kubeconfig", hostKubeconfig, "get", "svc", svcName, "-n", ns, "-o", "json")
-			out, err := cmd.CombinedOutput()
+			out, err := runCommand(ctx, cmd)
 			if err != nil {
-				log.Println("DEBUG: kubectl get svc error:", err, "output:", string(out))
+				logger(ctx).Debug("getting service failed", "cluster", clusterName, "err", err, "output", string(out))
 				continue
 			}
 			var svc ServiceJSON
 			if err := json.Unmarshal(out, &svc); err != nil {
-				log.Println("DEBUG: error unmarshaling service JSON:", err)
+				logger(ctx).Debug("parsing service failed", "cluster", clusterName, "err", err)
 				continue
 			}
 			if len(svc.Status.LoadBalancer.Ingress) > 0 {
@@ -1039,10 +1637,9 @@ func pollForExternalEndpoint(hostKubeconfig, clusterName string) (string, error)
 				} else {
 					endpoint = "https://" + external + ":" + strconv.Itoa(port)
 				}
-				log.Println("DEBUG: found external endpoint:", endpoint)
+				logger(ctx).Info("found external endpoint", "cluster", clusterName, "endpoint", endpoint)
 				return endpoint, nil
 			}
-			log.Println("DEBUG: external endpoint not available yet; polling...")
 		}
 	}
 }
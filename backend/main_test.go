@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCreateVclusterYAML(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Ingress.BaseDomain = "dev.example.com"
+	useConfig(t, cfg)
+	tests := []struct {
+		name        string
+		params      ClusterParams
+		replicas    int
+		etcd        bool
+		serviceType string
+		sans        []string
+	}{
+		{"default", ClusterParams{}, 1, false, "ClusterIP", nil},
+		{"ha", ClusterParams{HA: true}, 3, true, "ClusterIP", nil},
+		{"scaled back from ha", ClusterParams{EmbeddedEtcd: true}, 1, true, "ClusterIP", nil},
+		{"legacy loadbalancer", ClusterParams{LoadBalancer: true}, 1, false, "LoadBalancer", nil},
+		{"nodeport", ClusterParams{Exposure: ExposureNodePort, NodeAddress: "10.0.0.7"}, 1, false, "NodePort", []string{"10.0.0.7"}},
+		{"ha ingress", ClusterParams{HA: true, Exposure: ExposureIngress}, 3, true, "ClusterIP", []string{"demo.dev.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := createVclusterYAML(dir, "demo", tt.params); err != nil {
+				t.Fatalf("createVclusterYAML() error = %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "vcluster.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got VclusterConfig
+			if err := yaml.UnmarshalStrict(data, &got); err != nil {
+				t.Fatalf("vcluster.yaml does not parse: %v\n%s", err, data)
+			}
+			cp := got.ControlPlane
+			if cp.StatefulSet.HighAvailability.Replicas != tt.replicas {
+				t.Errorf("replicas = %d, want %d", cp.StatefulSet.HighAvailability.Replicas, tt.replicas)
+			}
+			if cp.BackingStore.Etcd.Embedded.Enabled != tt.etcd {
+				t.Errorf("embedded etcd = %v, want %v", cp.BackingStore.Etcd.Embedded.Enabled, tt.etcd)
+			}
+			if !tt.etcd && strings.Contains(string(data), "backingStore") {
+				t.Errorf("vcluster.yaml sets a backing store for a single replica:\n%s", data)
+			}
+			if cp.Service.Spec.Type != tt.serviceType {
+				t.Errorf("service type = %q, want %q", cp.Service.Spec.Type, tt.serviceType)
+			}
+			if strings.Join(cp.Proxy.ExtraSANs, ",") != strings.Join(tt.sans, ",") {
+				t.Errorf("extraSANs = %q, want %q", cp.Proxy.ExtraSANs, tt.sans)
+			}
+		})
+	}
+}
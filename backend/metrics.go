@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The metrics below are exposed on /metrics in the Prometheus text format.
+// The format is written directly rather than through client_golang to keep the
+// backend's dependencies to yaml only.
+
+var (
+	defaultBuckets    = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	operationBuckets  = []float64{10, 30, 60, 90, 120, 180, 240, 300, 450, 600, 900}
+	subprocessBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	stageBuckets      = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600}
+
+	httpRequests = newCounterVec("kubehatch_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = newHistogramVec("kubehatch_http_request_duration_seconds",
+		"HTTP request latency by route.", defaultBuckets, "route")
+	operationDuration = newHistogramVec("kubehatch_operation_duration_seconds",
+		"Duration of cluster create and delete operations.", operationBuckets, "operation", "outcome")
+	operationStageDuration = newHistogramVec("kubehatch_operation_stage_duration_seconds",
+		"Duration of each stage of cluster creates and deletes.", stageBuckets, "operation", "stage")
+	operationFailures = newCounterVec("kubehatch_operation_failures_total",
+		"Failed cluster operations by the stage that failed.", "operation", "stage")
+	subprocessDuration = newHistogramVec("kubehatch_subprocess_duration_seconds",
+		"Latency of kubectl and vcluster invocations.", subprocessBuckets, "command", "subcommand")
+	subprocessExits = newCounterVec("kubehatch_subprocess_exits_total",
+		"kubectl and vcluster invocations by exit code (-1 if the process did not start).", "command", "subcommand", "code")
+	poolClaims = newCounterVec("kubehatch_pool_claims_total",
+		"Creates that named a pool, by whether a ready cluster was claimed (hit) or one had to be installed (miss).", "pool", "result")
+	poolProvisionDuration = newHistogramVec("kubehatch_pool_provision_duration_seconds",
+		"Time to install a pooled cluster until it is ready to claim.", operationBuckets, "pool")
+	poolProvisionFailures = newCounterVec("kubehatch_pool_provision_failures_total",
+		"Failed installs of pooled clusters.", "pool")
+	queueWait = newHistogramVec("kubehatch_queue_wait_seconds",
+		"Time installs waited in the provisioning queue for a slot.", operationBuckets)
+	kubeconfigFallbacks = newCounterVec("kubehatch_kubeconfig_fallbacks_total",
+		"Times vcluster connect failed and the kubeconfig was read from the secret instead.", "path")
+
+	registry = []collector{
+		httpRequests, httpDuration,
+		operationDuration, operationStageDuration, operationFailures,
+		subprocessDuration, subprocessExits,
+		kubeconfigFallbacks,
+		poolClaims, poolProvisionDuration, poolProvisionFailures,
+		vclusterGauge{},
+		poolGauge{},
+		queueWait, queueGauge{},
+		leaderGauge{},
+	}
+)
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// labelKey joins label values into a map key; \xff cannot appear in them.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, key string, extra ...string) string {
+	values := strings.Split(key, "\xff")
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[labelKey(values)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatFloat(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), hist.count)
+	}
+}
+
+// vclusterCountInterval is how often the clusters on the host are counted for
+// kubehatch_vclusters, and bounds how long one count may take.
+const vclusterCountInterval = time.Minute
+
+// vclusterCounts holds the latest count, so that scrapes never wait on the
+// host.
+var vclusterCounts atomic.Pointer[map[string]float64]
+
+// countVclusters refreshes vclusterCounts until ctx is done.
+func countVclusters(ctx context.Context) {
+	ticker := time.NewTicker(vclusterCountInterval)
+	defer ticker.Stop()
+	for {
+		countCtx, cancel := context.WithTimeout(ctx, vclusterCountInterval)
+		hostKubeconfig := getDefaultKubeconfig()
+		host := hostLabel(hostKubeconfig)
+		clusters, err := listVclusters(countCtx, hostKubeconfig, "default")
+		cancel()
+		if err != nil {
+			logger(ctx).Error("listing clusters for metrics failed", "err", err)
+		} else {
+			counts := map[string]float64{}
+			for _, c := range clusters {
+				counts[labelKey([]string{c.Status, c.Owner, host})]++
+			}
+			vclusterCounts.Store(&counts)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// vclusterGauge reports the clusters on the default host by status and owner,
+// as of the latest count. Clusters created with an uploaded kubeconfig live on
+// hosts KubeHatch does not keep credentials for and are not counted.
+type vclusterGauge struct{}
+
+var vclusterGaugeLabels = []string{"status", "owner", "host"}
+
+func (vclusterGauge) writeTo(w io.Writer) {
+	name := "kubehatch_vclusters"
+	fmt.Fprintf(w, "# HELP %s Virtual clusters by status, owner and host.\n# TYPE %s gauge\n", name, name)
+	counts := vclusterCounts.Load()
+	if counts == nil {
+		return
+	}
+	keys := make([]string, 0, len(*counts))
+	for k := range *counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(vclusterGaugeLabels, k), formatFloat((*counts)[k]))
+	}
+}
+
+// hostLabel names a host cluster by the API server host of the kubeconfig's
+// current context, or "in-cluster" without a kubeconfig.
+func hostLabel(hostKubeconfig string) string {
+	if hostKubeconfig == "" {
+		return "in-cluster"
+	}
+	data, err := os.ReadFile(hostKubeconfig)
+	if err != nil {
+		return "unknown"
+	}
+	var config struct {
+		CurrentContext string `yaml:"current-context"`
+		Contexts       []struct {
+			Name    string `yaml:"name"`
+			Context struct {
+				Cluster string `yaml:"cluster"`
+			} `yaml:"context"`
+		} `yaml:"contexts"`
+		Clusters []struct {
+			Name    string `yaml:"name"`
+			Cluster struct {
+				Server string `yaml:"server"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "unknown"
+	}
+	clusterName := ""
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName = c.Context.Cluster
+		}
+	}
+	for _, c := range config.Clusters {
+		if c.Name == clusterName {
+			if u, err := url.Parse(c.Cluster.Server); err == nil && u.Host != "" {
+				return u.Host
+			}
+			return c.Cluster.Server
+		}
+	}
+	return "unknown"
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range registry {
+		c.writeTo(w)
+	}
+}
+
+// statusWriter records the status code written by a handler. It passes
+// Flush through for streamed responses and unwraps for
+// http.ResponseController, which the proxy uses to hijack upgrades.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseStatus returns the status written so far through a statusWriter,
+// 200 if nothing has been written yet.
+func responseStatus(w http.ResponseWriter) int {
+	if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+		return sw.status
+	}
+	return http.StatusOK
+}
+
+// instrument assigns each request a correlation ID (echoed in X-Request-Id),
+// records request counts and latencies, and runs the handler in a server span
+// that continues the caller's trace.
+func instrument(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeLabel(r.URL.Path)
+		requestID := newRequestID(r.Header.Get("X-Request-Id"))
+		w.Header().Set("X-Request-Id", requestID)
+		ctx := withRequestID(r.Context(), requestID)
+		ctx, span := startSpan(extractTraceContext(ctx, r.Header), r.Method+" "+route, spanKindServer,
+			attrString("http.request.method", r.Method),
+			attrString("http.route", route),
+			attrString("enduser.id", getUserFromRequest(r)))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r.WithContext(ctx))
+		status := responseStatus(sw)
+		span.SetAttributes(attrInt("http.response.status_code", status))
+		if status >= 500 {
+			span.RecordError(fmt.Errorf("%s", http.StatusText(status)))
+		}
+		httpRequests.inc(route, r.Method, strconv.Itoa(status))
+		httpDuration.observe(time.Since(start).Seconds(), route)
+		logger(ctx).Info("request completed", "method", r.Method, "route", route, "status", status, "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// detailSubresources are the known paths under /api/vcluster/{name}/.
+var detailSubresources = map[string]bool{
+	"kubeconfig": true, "download-url": true, "token": true, "logs": true, "credentials": true,
+}
+
+// routeLabel maps a request path to its route pattern so that cluster names
+// do not end up in label values.
+func routeLabel(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/vcluster/"):
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/vcluster/"), "/"), "/")
+		route := "/api/vcluster/{name}"
+		if len(parts) >= 2 {
+			if !detailSubresources[parts[1]] {
+				return "other"
+			}
+			route += "/" + parts[1]
+		}
+		if len(parts) == 3 && parts[1] == "credentials" {
+			route += "/{id}"
+		}
+		return route
+	case strings.HasPrefix(path, "/proxy/"):
+		return "/proxy/{name}"
+	case strings.HasPrefix(path, "/api/operations/"):
+		return "/api/operations/{id}"
+	case path == "/api/vcluster", path == "/api/vclusters", path == "/api/vclusters/kubeconfig",
+		path == "/api/audit", path == "/api/config", path == "/api/operations", path == "/download", path == "/metrics":
+		return path
+	default:
+		return "other"
+	}
+}
+
+// runCommand runs cmd like CombinedOutput, isolated by runIsolated, and
+// records its latency and exit code.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	span := startCommandSpan(ctx, cmd)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := runIsolated(ctx, cmd)
+	observeCommand(ctx, cmd, start, span, err)
+	return out.Bytes(), err
+}
+
+// runCommandOutput runs cmd like Output, isolated by runIsolated, and records
+// its latency and exit code.
+func runCommandOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	span := startCommandSpan(ctx, cmd)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := runIsolated(ctx, cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	observeCommand(ctx, cmd, start, span, err)
+	return stdout.Bytes(), err
+}
+
+// startCommandSpan starts a span for a subprocess. Arguments are not recorded
+// since they may include kubeconfig paths.
+func startCommandSpan(ctx context.Context, cmd *exec.Cmd) *Span {
+	command, subcommand := commandLabels(cmd.Args)
+	_, span := startSpan(ctx, strings.TrimSpace(command+" "+subcommand), spanKindClient,
+		attrString("process.executable.name", command),
+		attrString("kubehatch.subcommand", subcommand))
+	return span
+}
+
+func observeCommand(ctx context.Context, cmd *exec.Cmd, start time.Time, span *Span, err error) {
+	command, subcommand := commandLabels(cmd.Args)
+	code := -1
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	}
+	subprocessDuration.observe(time.Since(start).Seconds(), command, subcommand)
+	subprocessExits.inc(command, subcommand, strconv.Itoa(code))
+	logger(ctx).Debug("subprocess finished", "command", command, "subcommand", subcommand, "exit_code", code, "duration_ms", time.Since(start).Milliseconds())
+	span.SetAttributes(attrInt("process.exit.code", code))
+	span.RecordError(err)
+	span.End()
+}
+
+// flagsWithValues are the global flags passed before a subcommand.
+var flagsWithValues = map[string]bool{"--kubeconfig": true, "--namespace": true, "-n": true, "--context": true}
+
+// commandLabels returns the binary name and its first positional argument.
+func commandLabels(args []string) (string, string) {
+	if len(args) == 0 {
+		return "", ""
+	}
+	command := filepath.Base(args[0])
+	for i := 1; i < len(args); i++ {
+		if flagsWithValues[args[i]] {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			return command, args[i]
+		}
+	}
+	return command, ""
+}
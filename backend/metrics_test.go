@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestRouteLabel(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/vclusters", "/api/vclusters"},
+		{"/api/vclusters/kubeconfig", "/api/vclusters/kubeconfig"},
+		{"/api/vcluster", "/api/vcluster"},
+		{"/api/vcluster/demo", "/api/vcluster/{name}"},
+		{"/api/vcluster/demo/", "/api/vcluster/{name}"},
+		{"/api/vcluster/demo/kubeconfig", "/api/vcluster/{name}/kubeconfig"},
+		{"/api/vcluster/demo/logs", "/api/vcluster/{name}/logs"},
+		{"/api/vcluster/demo/credentials", "/api/vcluster/{name}/credentials"},
+		{"/api/vcluster/demo/credentials/abc123", "/api/vcluster/{name}/credentials/{id}"},
+		{"/api/vcluster/demo/secrets", "other"},
+		{"/proxy/demo/api/v1/pods", "/proxy/{name}"},
+		{"/api/operations", "/api/operations"},
+		{"/api/operations/req-1", "/api/operations/{id}"},
+		{"/api/audit", "/api/audit"},
+		{"/api/config", "/api/config"},
+		{"/download", "/download"},
+		{"/metrics", "/metrics"},
+		{"/", "other"},
+		{"/api/demo-cluster-name", "other"},
+	}
+	for _, tt := range tests {
+		if got := routeLabel(tt.path); got != tt.want {
+			t.Errorf("routeLabel(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errOperationCancelled is the cancel cause of an operation stopped through
+// DELETE /api/operations/{id}.
+var errOperationCancelled = errors.New("cancelled by request")
+
+// rollbackTimeout bounds the cleanup after a cancelled or failed create.
+const rollbackTimeout = 5 * time.Minute
+
+// operation tracks a create or delete: its current stage, so that a failure
+// can be attributed to it, and its cancellation. Each stage runs in its own
+// span and under the deadline configured in timeouts.stages.
+type operation struct {
+	id          string
+	name        string
+	cluster     string
+	user        string
+	start       time.Time
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	span        *Span
+	rollbackFn  func(context.Context) error
+	failureFn   func(ctx context.Context, stage, msg string) string
+	stageCancel context.CancelFunc
+	stageSpan   *Span
+	stageStart  time.Time
+	// persistHost is the host of the namespace the operation is recorded on,
+	// once persisted is set.
+	persistHost string
+	persisted   bool
+	// replica runs the operation, "" once it gave it up.
+	replica string
+	unlock  func()
+
+	mu       sync.Mutex
+	stage    string
+	stageCtx context.Context
+}
+
+// OperationInfo describes an in-flight operation.
+type OperationInfo struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	Cluster   string    `json:"cluster"`
+	User      string    `json:"user"`
+	Stage     string    `json:"stage"`
+	StartedAt time.Time `json:"startedAt"`
+	Replica   string    `json:"replica,omitempty"`
+	// QueuePosition and EstimatedStart are set while a create waits in the
+	// provisioning queue.
+	QueuePosition  int        `json:"queuePosition,omitempty"`
+	EstimatedStart *time.Time `json:"estimatedStart,omitempty"`
+}
+
+var (
+	operationsMu sync.Mutex
+	operations   = map[string]*operation{}
+)
+
+// startOperation registers an operation under the request's ID, which is
+// returned in X-Operation-Id. Clients that need to cancel a create while it
+// runs can pick the ID themselves by sending X-Request-Id. The operation
+// outlives a client that disconnects: only DELETE /api/operations/{id} and
+// stage deadlines stop it.
+func startOperation(ctx context.Context, w http.ResponseWriter, name, clusterName, user string) *operation {
+	ctx, span := startSpan(ctx, name, spanKindInternal, attrString("kubehatch.cluster", clusterName))
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	op := &operation{name: name, cluster: clusterName, user: user, start: time.Now(), ctx: ctx, cancel: cancel, span: span, replica: replicaID}
+
+	operationsMu.Lock()
+	op.id = requestIDFromContext(ctx)
+	if _, taken := operations[op.id]; taken || op.id == "" {
+		op.id = newRequestID("")
+	}
+	operations[op.id] = op
+	operationsMu.Unlock()
+
+	w.Header().Set("X-Operation-Id", op.id)
+	op.setStage("validate")
+	return op
+}
+
+// setCluster sets the cluster once it is known, for creates from a pool.
+func (op *operation) setCluster(clusterName string) {
+	operationsMu.Lock()
+	op.cluster = clusterName
+	operationsMu.Unlock()
+	op.setAttributes(attrString("kubehatch.cluster", clusterName))
+}
+
+// startBackgroundOperation starts an operation that no client waits for,
+// under the given ID. done logs its error response, if any, and finishes it.
+func startBackgroundOperation(id, name, clusterName, user string) (http.ResponseWriter, *operation, func()) {
+	bw := &backgroundWriter{header: http.Header{}}
+	w := &statusWriter{ResponseWriter: bw}
+	op := startOperation(withRequestID(context.Background(), id), w, name, clusterName, user)
+	return w, op, func() {
+		if status := responseStatus(w); status >= 400 {
+			logger(op.ctx).Error("background operation failed", "operation", name, "cluster", op.cluster,
+				"status", status, "err", strings.TrimSpace(bw.body.String()))
+		}
+		op.finish(w)
+	}
+}
+
+// backgroundWriter takes the response of an operation that no client waits
+// for.
+type backgroundWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *backgroundWriter) Header() http.Header         { return w.header }
+func (w *backgroundWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *backgroundWriter) WriteHeader(int)             {}
+
+// setAttributes adds attributes to the operation span.
+func (op *operation) setAttributes(attrs ...attribute) {
+	op.span.SetAttributes(attrs...)
+}
+
+// setStage marks the start of the next stage and returns the context to run
+// it in.
+func (op *operation) setStage(stage string) context.Context {
+	op.endStage()
+	if op.stageCancel != nil {
+		op.stageCancel()
+	}
+	ctx, stageSpan := startSpan(op.ctx, op.name+" "+stage, spanKindInternal, attrString("kubehatch.stage", stage))
+	var stageCancel context.CancelFunc
+	if timeout := currentConfig().Timeouts.Stages[stage].Duration; timeout > 0 {
+		ctx, stageCancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, stageCancel = context.WithCancel(ctx)
+	}
+	op.stageSpan, op.stageCancel, op.stageStart = stageSpan, stageCancel, time.Now()
+
+	op.mu.Lock()
+	op.stage, op.stageCtx = stage, ctx
+	op.mu.Unlock()
+	if op.persisted {
+		op.persistStage(ctx)
+	}
+	return ctx
+}
+
+// endStage ends the span of the current stage and records its duration.
+func (op *operation) endStage() {
+	if op.stageStart.IsZero() {
+		return
+	}
+	op.stageSpan.End()
+	operationStageDuration.observe(time.Since(op.stageStart).Seconds(), op.name, op.currentStage())
+}
+
+func (op *operation) currentStage() string {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.stage
+}
+
+// onCancel sets the cleanup that undoes the operation if it is cancelled from
+// this point on.
+func (op *operation) onCancel(rollback func(context.Context) error) {
+	op.rollbackFn = rollback
+}
+
+// onFailure sets the handler for a failure from this point on, other than a
+// cancellation. It returns a note for the error response.
+func (op *operation) onFailure(handle func(ctx context.Context, stage, msg string) string) {
+	op.failureFn = handle
+}
+
+// fail writes the error response for the current stage. A cancelled
+// operation is rolled back and answered with 409, unless it lost its cluster
+// lock or was stopped by a shutdown (503), a stage that ran past its deadline
+// with 504; anything else gets msg and status. Failures other than
+// cancellation are passed to the onFailure handler first.
+func (op *operation) fail(w http.ResponseWriter, msg string, status int) {
+	op.mu.Lock()
+	stage, stageCtx := op.stage, op.stageCtx
+	op.mu.Unlock()
+
+	switch {
+	case op.ctx.Err() != nil:
+		cause := context.Cause(op.ctx)
+		logger(op.ctx).Warn("operation cancelled", "operation", op.name, "cluster", op.cluster, "stage", stage, "cause", cause)
+		result, status := "nothing to roll back", http.StatusConflict
+		switch {
+		case errors.Is(cause, errLockLost):
+			// Another replica may be resuming the operation.
+			result = "left to the holder of the lock"
+		case errors.Is(cause, errShuttingDown):
+			result, status = "left for another replica to resume", http.StatusServiceUnavailable
+		case op.rollbackFn != nil:
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(op.ctx), rollbackTimeout)
+			defer cancel()
+			if err := op.rollbackFn(ctx); err != nil {
+				logger(ctx).Error("rollback failed", "operation", op.name, "cluster", op.cluster, "err", err)
+				result = "rollback failed: " + err.Error()
+			} else {
+				logger(ctx).Info("rolled back", "operation", op.name, "cluster", op.cluster)
+				result = "rolled back"
+			}
+		}
+		http.Error(w, fmt.Sprintf("%s of %s %s at stage %s; %s", op.name, op.cluster, cause, stage, result), status)
+	default:
+		if errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+			msg = fmt.Sprintf("%s: stage %s timed out after %s", msg, stage, currentConfig().Timeouts.Stages[stage])
+			status = http.StatusGatewayTimeout
+		}
+		if op.failureFn != nil {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(op.ctx), rollbackTimeout)
+			defer cancel()
+			if note := op.failureFn(ctx, stage, msg); note != "" {
+				msg += "; " + note
+			}
+		}
+		http.Error(w, msg, status)
+	}
+}
+
+// finish unregisters the operation and records its duration and, if the
+// response was an error, the stage that failed.
+func (op *operation) finish(w http.ResponseWriter) {
+	operationsMu.Lock()
+	delete(operations, op.id)
+	operationsMu.Unlock()
+	switch {
+	case op.persisted && errors.Is(context.Cause(op.ctx), errLockLost):
+		op.disownIfRecorded()
+	case op.persisted && errors.Is(context.Cause(op.ctx), errShuttingDown):
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(op.ctx), persistTimeout)
+		op.disown(ctx)
+		cancel()
+	case op.persisted:
+		op.unpersist()
+	}
+	if op.unlock != nil {
+		op.unlock()
+	}
+	op.cancel(nil)
+	if op.stageCancel != nil {
+		op.stageCancel()
+	}
+
+	stage := op.currentStage()
+	outcome := "success"
+	if status := responseStatus(w); status >= 400 {
+		outcome = "failure"
+		operationFailures.inc(op.name, stage)
+		err := fmt.Errorf("%s failed at stage %s with status %d", op.name, stage, status)
+		op.stageSpan.RecordError(err)
+		op.span.RecordError(err)
+	}
+	op.endStage()
+	op.span.SetAttributes(attrString("kubehatch.outcome", outcome))
+	op.span.End()
+	operationDuration.observe(time.Since(op.start).Seconds(), op.name, outcome)
+}
+
+func (op *operation) info() OperationInfo {
+	info := OperationInfo{
+		ID:        op.id,
+		Operation: op.name,
+		Cluster:   op.cluster,
+		User:      op.user,
+		Stage:     op.currentStage(),
+		StartedAt: op.start,
+		Replica:   op.replica,
+	}
+	if info.Stage == "queued" {
+		if pos, eta, ok := provisioning.position(op.id); ok {
+			info.QueuePosition, info.EstimatedStart = pos, &eta
+		}
+	}
+	return info
+}
+
+// operationsHandler serves GET /api/operations, the in-flight operations the
+// user may see, and DELETE /api/operations/{id}, which cancels one. The
+// cancelled create rolls back in its own request; DELETE returns 202 at once.
+// With coordination, both also cover the operations other replicas recorded
+// on the default host.
+func operationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	currentUser := getUserFromRequest(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/operations"), "/")
+	shared := currentConfig().Coordination.Enabled
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		operationsMu.Lock()
+		result := []OperationInfo{}
+		for _, op := range operations {
+			if isAdminUser(currentUser) || op.user == currentUser {
+				result = append(result, op.info())
+			}
+		}
+		local := len(result)
+		operationsMu.Unlock()
+		if shared {
+			records, err := recordedOperations(ctx)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error listing operations: %v", err), http.StatusInternalServerError)
+				return
+			}
+			for _, rec := range records {
+				operationsMu.Lock()
+				_, running := operations[rec.ID]
+				operationsMu.Unlock()
+				if !running && (isAdminUser(currentUser) || rec.User == currentUser) {
+					result = append(result, rec)
+				}
+			}
+			if len(result) > local {
+				if err := provisioning.placeShared(ctx, result[local:]); err != nil {
+					logger(ctx).Warn("reading the shared queue failed", "err", err)
+				}
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	case r.Method == http.MethodDelete && id != "":
+		operationsMu.Lock()
+		op, ok := operations[id]
+		operationsMu.Unlock()
+		var info OperationInfo
+		if ok {
+			info = op.info()
+		} else if shared {
+			records, err := recordedOperations(ctx)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error listing operations: %v", err), http.StatusInternalServerError)
+				return
+			}
+			for _, rec := range records {
+				if rec.ID == id {
+					info, ok = rec, true
+				}
+			}
+		}
+		w, done := auditAction(w, r, AuditOperationCancel, info.Cluster, map[string]interface{}{"id": id})
+		defer done()
+		if !ok {
+			http.Error(w, "Operation not found or already finished", http.StatusNotFound)
+			return
+		}
+		if !isAdminUser(currentUser) && info.User != currentUser {
+			logger(ctx).Warn("operation cancel denied", "user", currentUser, "operation", id)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if op != nil {
+			op.cancel(errOperationCancelled)
+		} else if err := requestCancel(ctx, info); err != nil {
+			http.Error(w, fmt.Sprintf("Error cancelling operation: %v", err), http.StatusInternalServerError)
+			return
+		}
+		logger(ctx).Info("operation cancel requested", "operation", id, "cluster", info.Cluster, "user", currentUser, "replica", info.Replica)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		http.Error(w, "Only GET /api/operations and DELETE /api/operations/{id} allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOperationCancel checks that only a cancel through the operations API
+// rolls a create back; a client that goes away or a lost lock does not.
+func TestOperationCancel(t *testing.T) {
+	useConfig(t, defaultConfig())
+	tests := []struct {
+		name         string
+		disconnect   bool
+		cause        error
+		wantStatus   int
+		wantRollback bool
+	}{
+		{"failure", false, nil, http.StatusInternalServerError, false},
+		{"client disconnects", true, nil, http.StatusInternalServerError, false},
+		{"cancelled by request", false, errOperationCancelled, http.StatusConflict, true},
+		{"cancelled after disconnect", true, errOperationCancelled, http.StatusConflict, true},
+		{"lock lost", false, errLockLost, http.StatusConflict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCtx, disconnect := context.WithCancel(context.Background())
+			defer disconnect()
+			rec := httptest.NewRecorder()
+			op := startOperation(reqCtx, rec, "create", "demo", "alice")
+			defer op.finish(rec)
+			rolledBack := false
+			op.rollbackFn = func(context.Context) error {
+				rolledBack = true
+				return nil
+			}
+			if tt.disconnect {
+				disconnect()
+			}
+			if tt.cause != nil {
+				op.cancel(tt.cause)
+			}
+			if tt.disconnect && tt.cause == nil && op.ctx.Err() != nil {
+				t.Fatalf("operation context ended with its request: %v", context.Cause(op.ctx))
+			}
+			op.fail(rec, "install failed", http.StatusInternalServerError)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rolledBack != tt.wantRollback {
+				t.Errorf("rolled back = %v, want %v", rolledBack, tt.wantRollback)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Warm pools keep clusters of a template installed and ready on the default
+// host. A pooled cluster belongs to poolOwner, so only admins see it, until a
+// create claims it by taking over the owner annotation.
+
+// poolOwner owns pooled clusters until they are claimed. The system: prefix
+// cannot be a user name behind the usual authenticating proxies.
+const poolOwner = "system:kubehatch-pool"
+
+// Namespace annotations of pooled clusters.
+const (
+	annotationPool      = "kubehatch.io/pool"
+	annotationPoolReady = "kubehatch.io/pool-ready"
+	// annotationPoolInstaller is the replica installing a pooled cluster.
+	annotationPoolInstaller = "kubehatch.io/pool-installer"
+)
+
+// poolRefillInterval is how often the pools are checked against their size.
+const poolRefillInterval = 30 * time.Second
+
+// poolProvisionTimeout bounds the install of a single pooled cluster.
+const poolProvisionTimeout = 20 * time.Minute
+
+// errPoolEmpty is returned when a pool has no ready cluster to claim.
+var errPoolEmpty = errors.New("no ready cluster in the pool")
+
+var (
+	poolMu sync.Mutex
+	// poolProvisioning holds the clusters being installed, by pool.
+	poolProvisioning = map[string]map[string]bool{}
+	// poolReadyCounts is the number of ready clusters per pool at the last
+	// refill.
+	poolReadyCounts = map[string]int{}
+	// poolRefillNow wakes the refiller, e.g. after a claim.
+	poolRefillNow = make(chan struct{}, 1)
+)
+
+func (p PoolConfig) params() ClusterParams {
+	exposure := p.Exposure
+	if exposure == "" {
+		exposure = ExposureNone
+	}
+	return ClusterParams{HA: p.HA, LoadBalancer: exposure == ExposureLoadBalancer, Exposure: exposure}
+}
+
+// newPoolClusterName returns a fresh cluster name for the pool.
+func newPoolClusterName(pool string) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return pool + "-" + hex.EncodeToString(b)
+}
+
+// pooledCluster returns the pool of a namespace and whether its cluster is
+// ready, if it is an unclaimed pooled cluster.
+func pooledCluster(ns NamespaceJSON) (pool string, ready, ok bool) {
+	annotations := ns.Metadata.Annotations
+	if annotations["kubehatch.io/owner"] != poolOwner || annotations[annotationPool] == "" {
+		return "", false, false
+	}
+	return annotations[annotationPool], annotations[annotationPoolReady] == "true", true
+}
+
+// claimPooledCluster hands the oldest ready cluster of the pool to owner and
+// returns its name and parameters. The owner annotation is updated against the
+// namespace's resourceVersion, so concurrent claims never take the same
+// cluster.
+func claimPooledCluster(ctx context.Context, hostKubeconfig, pool, owner string) (string, ClusterParams, error) {
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		return "", ClusterParams{}, err
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Metadata.CreationTimestamp.Before(namespaces[j].Metadata.CreationTimestamp)
+	})
+	for _, ns := range namespaces {
+		if p, ready, ok := pooledCluster(ns); !ok || p != pool || !ready || ns.Status.Phase == "Terminating" {
+			continue
+		}
+		args := []string{"annotate", "namespace", ns.Metadata.Name, "--overwrite",
+			"--resource-version=" + ns.Metadata.ResourceVersion,
+			"kubehatch.io/owner=" + owner, annotationPool + "-", annotationPoolReady + "-"}
+		if hostKubeconfig != "" {
+			args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+		}
+		out, err := runCommand(ctx, exec.Command("kubectl", args...))
+		if err != nil {
+			if strings.Contains(string(out), "Conflict") || strings.Contains(string(out), "the object has been modified") {
+				continue
+			}
+			return "", ClusterParams{}, fmt.Errorf("%v, output: %s", err, string(out))
+		}
+		var params ClusterParams
+		if data := ns.Metadata.Annotations["kubehatch.io/params"]; data != "" {
+			if err := json.Unmarshal([]byte(data), &params); err != nil {
+				return "", ClusterParams{}, fmt.Errorf("invalid parameters on claimed cluster: %v", err)
+			}
+		}
+		clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+		auditEvent(ctx, owner, AuditOwnershipChange, clusterName, map[string]interface{}{"from": poolOwner, "to": owner, "pool": pool})
+		poolClaims.inc(pool, "hit")
+		logger(ctx).Info("claimed pooled cluster", "pool", pool, "cluster", clusterName, "owner", owner)
+		select {
+		case poolRefillNow <- struct{}{}:
+		default:
+		}
+		return clusterName, params, nil
+	}
+	poolClaims.inc(pool, "miss")
+	return "", ClusterParams{}, errPoolEmpty
+}
+
+// refillPools keeps every configured pool at its size on the default host. It
+// also removes pooled clusters of pools that are gone or shrank, and ones left
+// half-installed by an earlier backend process.
+func refillPools(ctx context.Context) {
+	ticker := time.NewTicker(poolRefillInterval)
+	defer ticker.Stop()
+	for {
+		refillPoolsOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-poolRefillNow:
+		}
+	}
+}
+
+func refillPoolsOnce(ctx context.Context) {
+	pools := currentConfig().Pools
+	// Installs are only started below, so a cluster that is neither ready in
+	// the listing nor in flight before it was taken is left over.
+	poolMu.Lock()
+	seen := len(poolReadyCounts) > 0
+	inFlightBefore := map[string]bool{}
+	for _, clusters := range poolProvisioning {
+		for clusterName := range clusters {
+			inFlightBefore[clusterName] = true
+		}
+	}
+	poolMu.Unlock()
+	if len(pools) == 0 && !seen {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rollbackTimeout)
+	defer cancel()
+	hostKubeconfig := getDefaultKubeconfig()
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		logger(ctx).Warn("listing pooled clusters failed", "err", err)
+		return
+	}
+	// Installs of a previous leader that is still around are left to finish.
+	alive, err := replicasAlive(ctx)
+	if err != nil {
+		logger(ctx).Warn("listing live replicas failed", "err", err)
+		return
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Metadata.CreationTimestamp.Before(namespaces[j].Metadata.CreationTimestamp)
+	})
+
+	configured := map[string]PoolConfig{}
+	for _, pool := range pools {
+		configured[pool.Name] = pool
+	}
+	ready := map[string][]string{}
+	elsewhere := map[string]int{}
+	var remove []string
+	poolMu.Lock()
+	for _, ns := range namespaces {
+		pool, isReady, ok := pooledCluster(ns)
+		if !ok || ns.Status.Phase == "Terminating" {
+			continue
+		}
+		clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+		installer := ns.Metadata.Annotations[annotationPoolInstaller]
+		_, keep := configured[pool]
+		switch {
+		case !keep:
+			remove = append(remove, clusterName)
+		case isReady:
+			ready[pool] = append(ready[pool], clusterName)
+		case inFlightBefore[clusterName] || poolProvisioning[pool][clusterName]:
+		case installer != replicaID && alive[installer]:
+			elsewhere[pool]++
+		default:
+			remove = append(remove, clusterName)
+		}
+	}
+	counts := map[string]int{}
+	for _, pool := range pools {
+		inFlight := len(poolProvisioning[pool.Name]) + elsewhere[pool.Name]
+		if surplus := len(ready[pool.Name]) + inFlight - pool.Size; surplus > 0 && len(ready[pool.Name]) > 0 {
+			if surplus > len(ready[pool.Name]) {
+				surplus = len(ready[pool.Name])
+			}
+			// Keep the oldest, they have been ready the longest.
+			n := len(ready[pool.Name])
+			remove = append(remove, ready[pool.Name][n-surplus:]...)
+			ready[pool.Name] = ready[pool.Name][:n-surplus]
+		}
+		counts[pool.Name] = len(ready[pool.Name])
+		for i := len(ready[pool.Name]) + inFlight; i < pool.Size; i++ {
+			clusterName := newPoolClusterName(pool.Name)
+			if poolProvisioning[pool.Name] == nil {
+				poolProvisioning[pool.Name] = map[string]bool{}
+			}
+			poolProvisioning[pool.Name][clusterName] = true
+			go provisionPoolCluster(hostKubeconfig, pool, clusterName)
+		}
+	}
+	poolReadyCounts = counts
+	poolMu.Unlock()
+
+	for _, clusterName := range remove {
+		if err := rollbackCreate(ctx, hostKubeconfig, clusterName); err != nil {
+			logger(ctx).Error("removing pooled cluster failed", "cluster", clusterName, "err", err)
+			continue
+		}
+		logger(ctx).Info("removed pooled cluster", "cluster", clusterName)
+	}
+}
+
+// provisionPoolCluster installs a cluster for the pool and marks it ready to
+// be claimed once its control plane is up. A failed install is removed.
+func provisionPoolCluster(hostKubeconfig string, pool PoolConfig, clusterName string) {
+	// Refills queue behind every create, before their deadline starts.
+	entry := provisioning.enqueue("pool/"+clusterName, hostLabel(hostKubeconfig), poolQueuePriority, time.Now())
+	release, _ := provisioning.wait(context.Background(), entry)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), poolProvisionTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "pool provision", spanKindInternal,
+		attrString("kubehatch.pool", pool.Name), attrString("kubehatch.cluster", clusterName))
+	defer span.End()
+	var err error
+	defer func() {
+		poolMu.Lock()
+		delete(poolProvisioning[pool.Name], clusterName)
+		if err == nil {
+			poolReadyCounts[pool.Name]++
+		}
+		poolMu.Unlock()
+	}()
+
+	start := time.Now()
+	logger(ctx).Info("provisioning pooled cluster", "pool", pool.Name, "cluster", clusterName)
+	if err = installPoolCluster(ctx, hostKubeconfig, pool, clusterName); err != nil {
+		span.RecordError(err)
+		poolProvisionFailures.inc(pool.Name)
+		logger(ctx).Error("provisioning pooled cluster failed", "pool", pool.Name, "cluster", clusterName, "err", err)
+		if errors.Is(err, errClusterExists) {
+			return
+		}
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		if err := rollbackCreate(cleanupCtx, hostKubeconfig, clusterName); err != nil {
+			logger(ctx).Error("removing failed pooled cluster failed", "cluster", clusterName, "err", err)
+		}
+		return
+	}
+	poolProvisionDuration.observe(time.Since(start).Seconds(), pool.Name)
+	logger(ctx).Info("pooled cluster ready", "pool", pool.Name, "cluster", clusterName, "duration_s", time.Since(start).Seconds())
+}
+
+func installPoolCluster(ctx context.Context, hostKubeconfig string, pool PoolConfig, clusterName string) error {
+	params := pool.params()
+	var err error
+	if params.Exposure == ExposureNodePort {
+		if params.NodeAddress, err = discoverNodeAddress(ctx, hostKubeconfig); err != nil {
+			return fmt.Errorf("discovering node address: %v", err)
+		}
+	}
+	workingDir := filepath.Join(".", "requests", "pool-"+clusterName)
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(workingDir)
+	if err := createVclusterYAML(workingDir, clusterName, params); err != nil {
+		return err
+	}
+	if err := createClusterNamespace(ctx, hostKubeconfig, clusterName, poolOwner, params, map[string]string{annotationPool: pool.Name, annotationPoolInstaller: replicaID}); err != nil {
+		return err
+	}
+	if err := createVirtualCluster(ctx, workingDir, clusterName, hostKubeconfig, params.LoadBalancer); err != nil {
+		return err
+	}
+	if params.Exposure == ExposureIngress {
+		if err := applyIngress(ctx, hostKubeconfig, clusterName); err != nil {
+			return err
+		}
+	}
+	replicas := controlPlaneReplicas(params)
+	waitCtx, cancelWait := context.WithTimeout(ctx, currentConfig().Timeouts.ReadyWait.Duration)
+	defer cancelWait()
+	if err := waitForControlPlane(waitCtx, hostKubeconfig, clusterName, replicas); err != nil {
+		return fmt.Errorf("waiting for the control plane: %v", err)
+	}
+
+	args := []string{"annotate", "namespace", "vcluster-" + clusterName, "--overwrite", annotationPoolReady + "=true"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	if out, err := runCommand(ctx, exec.Command("kubectl", args...)); err != nil {
+		return fmt.Errorf("marking the cluster ready: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// poolGauge reports the ready and provisioning clusters and the size of every
+// configured pool.
+type poolGauge struct{}
+
+func (poolGauge) writeTo(w io.Writer) {
+	pools := currentConfig().Pools
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	name := "kubehatch_pool_clusters"
+	fmt.Fprintf(w, "# HELP %s Pooled clusters by pool and state.\n# TYPE %s gauge\n", name, name)
+	labels := []string{"pool", "state"}
+	for _, pool := range pools {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, labelKey([]string{pool.Name, "provisioning"})), len(poolProvisioning[pool.Name]))
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, labelKey([]string{pool.Name, "ready"})), poolReadyCounts[pool.Name])
+	}
+	name = "kubehatch_pool_size"
+	fmt.Fprintf(w, "# HELP %s Configured size of each pool.\n# TYPE %s gauge\n", name, name)
+	for _, pool := range pools {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels([]string{"pool"}, labelKey([]string{pool.Name})), pool.Size)
+	}
+}
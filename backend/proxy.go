@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// proxyTargetTTL bounds how long a resolved service address and its client
+// credentials are reused before they are read from the host again.
+const proxyTargetTTL = 5 * time.Minute
+
+// proxyTarget is a resolved virtual API server with a transport that
+// authenticates as the vcluster admin.
+type proxyTarget struct {
+	endpoint  *url.URL
+	transport *http.Transport
+	resolved  time.Time
+	// roleBindings records the roles whose impersonation bindings exist.
+	roleBindings map[string]bool
+}
+
+var (
+	proxyTargetsMu sync.Mutex
+	proxyTargets   = map[string]*proxyTarget{}
+)
+
+// proxyHandler serves /proxy/{cluster}/...: an authenticating reverse proxy to
+// the virtual API server's in-cluster service. Callers authenticate to
+// KubeHatch as for any other route; requests are forwarded with the vcluster
+// admin credentials and impersonate kubehatch:<user> in the kubehatch:<role>
+// group, where role is the highest role the caller has on the cluster.
+// Watches and upgraded connections (exec, attach, port-forward) are supported.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rest := strings.TrimPrefix(r.URL.Path, "/proxy/")
+	clusterName, apiPath, _ := strings.Cut(rest, "/")
+	if clusterName == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	hostKubeconfig := getDefaultKubeconfig()
+	if !authorizeCluster(w, r, clusterName, hostKubeconfig) {
+		return
+	}
+	currentUser := getUserFromRequest(r)
+	role := maxRoleFor(currentUser, getClusterOwner(ctx, hostKubeconfig, clusterName))
+
+	target, err := getProxyTarget(ctx, hostKubeconfig, clusterName)
+	if err != nil {
+		logger(ctx).Error("proxy target unavailable", "cluster", clusterName, "err", err)
+		http.Error(w, fmt.Sprintf("Error reaching cluster: %v", err), http.StatusBadGateway)
+		return
+	}
+	if err := ensureImpersonationBinding(ctx, hostKubeconfig, clusterName, target, role); err != nil {
+		logger(ctx).Error("preparing proxy access failed", "cluster", clusterName, "err", err)
+		http.Error(w, fmt.Sprintf("Error preparing cluster access: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target.endpoint)
+			pr.Out.URL.Path = "/" + apiPath
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = target.endpoint.Host
+			// KubeHatch credentials must not reach the virtual cluster, and
+			// callers must not choose whom to impersonate.
+			pr.Out.Header.Del("Authorization")
+			for key := range pr.Out.Header {
+				if strings.HasPrefix(strings.ToLower(key), "impersonate-") {
+					pr.Out.Header.Del(key)
+				}
+			}
+			pr.Out.Header.Set("Impersonate-User", "kubehatch:"+currentUser)
+			pr.Out.Header.Add("Impersonate-Group", "kubehatch:"+role)
+			pr.Out.Header.Add("Impersonate-Group", "system:authenticated")
+			injectTraceContext(pr.In.Context(), pr.Out.Header)
+		},
+		Transport:     target.transport,
+		FlushInterval: -1, // stream watches as they arrive
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger(r.Context()).Error("proxying request failed", "cluster", clusterName, "err", err)
+			invalidateProxyTarget(clusterName)
+			http.Error(w, "Error reaching cluster", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// getProxyTarget resolves the in-cluster service of a vcluster and builds a
+// transport with the admin client certificate from the vc-<name> secret.
+func getProxyTarget(ctx context.Context, hostKubeconfig, clusterName string) (*proxyTarget, error) {
+	proxyTargetsMu.Lock()
+	if t, ok := proxyTargets[clusterName]; ok && time.Since(t.resolved) < proxyTargetTTL {
+		proxyTargetsMu.Unlock()
+		return t, nil
+	}
+	proxyTargetsMu.Unlock()
+
+	endpoint, err := getClusterIPEndpoint(ctx, hostKubeconfig, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	kcData, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := kubeconfigTLSConfig(kcData)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &proxyTarget{
+		endpoint: u,
+		transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 10,
+		},
+		resolved:     time.Now(),
+		roleBindings: map[string]bool{},
+	}
+	proxyTargetsMu.Lock()
+	proxyTargets[clusterName] = t
+	proxyTargetsMu.Unlock()
+	return t, nil
+}
+
+func invalidateProxyTarget(clusterName string) {
+	proxyTargetsMu.Lock()
+	defer proxyTargetsMu.Unlock()
+	if t, ok := proxyTargets[clusterName]; ok {
+		t.transport.CloseIdleConnections()
+		delete(proxyTargets, clusterName)
+	}
+}
+
+// kubeconfigTLSConfig builds a client TLS config from the first cluster and
+// user of a kubeconfig with embedded certificate data.
+func kubeconfigTLSConfig(kcData []byte) (*tls.Config, error) {
+	var config struct {
+		Clusters []struct {
+			Cluster struct {
+				CertificateAuthorityData string `yaml:"certificate-authority-data"`
+				InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		Users []struct {
+			User struct {
+				ClientCertificateData string `yaml:"client-certificate-data"`
+				ClientKeyData         string `yaml:"client-key-data"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(kcData, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconfig: %v", err)
+	}
+	if len(config.Clusters) == 0 || len(config.Users) == 0 {
+		return nil, fmt.Errorf("kubeconfig has no cluster or user")
+	}
+
+	cert, err := base64.StdEncoding.DecodeString(config.Users[0].User.ClientCertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(config.Users[0].User.ClientKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client key: %v", err)
+	}
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client key pair: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	cluster := config.Clusters[0].Cluster
+	if cluster.InsecureSkipTLSVerify {
+		tlsConfig.InsecureSkipVerify = true
+		return tlsConfig, nil
+	}
+	ca, err := base64.StdEncoding.DecodeString(cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate authority: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubeconfig has no usable certificate authority")
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// ensureImpersonationBinding binds the kubehatch:<role> group to the role's
+// ClusterRole inside the virtual cluster, once per resolved target.
+func ensureImpersonationBinding(ctx context.Context, hostKubeconfig, clusterName string, target *proxyTarget, role string) error {
+	proxyTargetsMu.Lock()
+	done := target.roleBindings[role]
+	proxyTargetsMu.Unlock()
+	if done {
+		return nil
+	}
+
+	kcData, err := getBackendKubeconfig(ctx, hostKubeconfig, clusterName, target.endpoint.String())
+	if err != nil {
+		return err
+	}
+	binding := map[string]interface{}{
+		"apiVersion": "rbac.authorization.k8s.io/v1",
+		"kind":       "ClusterRoleBinding",
+		"metadata": map[string]interface{}{
+			"name":   "kubehatch-proxy-" + role,
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "kubehatch"},
+		},
+		"roleRef": map[string]interface{}{
+			"apiGroup": "rbac.authorization.k8s.io",
+			"kind":     "ClusterRole",
+			"name":     roleClusterRoles[role],
+		},
+		"subjects": []interface{}{
+			map[string]interface{}{"apiGroup": "rbac.authorization.k8s.io", "kind": "Group", "name": "kubehatch:" + role},
+		},
+	}
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	if out, err := runVirtualKubectl(ctx, kcData, data, "apply", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to apply proxy role binding: %v, output: %s", err, string(out))
+	}
+
+	proxyTargetsMu.Lock()
+	target.roleBindings[role] = true
+	proxyTargetsMu.Unlock()
+	return nil
+}
+
+// kubeconfigForProxy returns a kubeconfig whose server is the KubeHatch proxy
+// for the cluster. It carries no cluster credentials: the user entry holds the
+// KubeHatch username, and the password is left for the user to fill in (or
+// the entry replaced, when KubeHatch sits behind an authenticating proxy).
+func kubeconfigForProxy(baseURL, clusterName, currentUser, name string) ([]byte, error) {
+	config := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Config",
+		"clusters": []interface{}{
+			map[string]interface{}{
+				"name":    name,
+				"cluster": map[string]interface{}{"server": baseURL + "/proxy/" + url.PathEscape(clusterName)},
+			},
+		},
+		"users": []interface{}{
+			map[string]interface{}{
+				"name": name,
+				"user": map[string]interface{}{"username": currentUser, "password": ""},
+			},
+		},
+		"contexts": []interface{}{
+			map[string]interface{}{
+				"name":    name,
+				"context": map[string]interface{}{"cluster": name, "user": name},
+			},
+		},
+		"current-context": name,
+		"preferences":     map[string]interface{}{},
+	}
+	return yaml.Marshal(config)
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Installs go through a single queue bounded by queue.maxConcurrent and
+// queue.maxPerHost. Waiting creates are ordered by priority, then by the time
+// they were queued; one whose host is at its limit lets the next one past.
+// A queued create is recorded on its namespace, so that the queue on the
+// default host can be restored after a restart.
+//
+// With coordination, the queue spans all replicas: every entry is also a
+// kubehatch-queue-<hash> Lease in coordination.namespace held by the replica
+// that waits for it. The leader hands out the slots by marking entries
+// started, under its own limits, and each replica with entries in line polls
+// the Leases to start its own and to tell their place in the whole queue.
+
+// Namespace annotations of a create waiting in the queue.
+const (
+	annotationQueuedAt      = "kubehatch.io/queued-at"
+	annotationQueuePriority = "kubehatch.io/queue-priority"
+)
+
+// Lease name prefix, label and annotations of the entries of the shared queue.
+// The Leases also carry annotationQueuedAt and annotationQueuePriority.
+const (
+	queueLeasePrefix       = "kubehatch-queue-"
+	labelQueueLease        = "kubehatch.io/queue"
+	annotationQueueID      = "kubehatch.io/queue-id"
+	annotationQueueHost    = "kubehatch.io/queue-host"
+	annotationQueueStarted = "kubehatch.io/queue-started"
+)
+
+// queuePollInterval is how often the shared queue is read.
+const queuePollInterval = 2 * time.Second
+
+// poolQueuePriority puts pool refills behind every create.
+const poolQueuePriority = math.MinInt32
+
+// defaultInstallEstimate is the assumed time an install holds its slot until
+// one has been measured.
+const defaultInstallEstimate = 3 * time.Minute
+
+type queueEntry struct {
+	id       string
+	host     string
+	priority int
+	queuedAt time.Time
+	seq      uint64
+	ready    chan struct{}
+	started  time.Time
+	// lease is the entry's Lease, on entries read from the shared queue.
+	lease LeaseJSON
+}
+
+// provisionQueue hands out install slots.
+type provisionQueue struct {
+	mu      sync.Mutex
+	waiting []*queueEntry
+	running map[string]int
+	total   int
+	seq     uint64
+	// estimate is a moving average of how long an install holds its slot.
+	estimate time.Duration
+	// polling is set while pollShared runs, and order holds the waiting
+	// entries of all replicas as it last read them.
+	polling bool
+	order   []*queueEntry
+}
+
+var provisioning = &provisionQueue{running: map[string]int{}, estimate: defaultInstallEstimate}
+
+func (e *queueEntry) before(o *queueEntry) bool {
+	if e.priority != o.priority {
+		return e.priority > o.priority
+	}
+	if !e.queuedAt.Equal(o.queuedAt) {
+		return e.queuedAt.Before(o.queuedAt)
+	}
+	if e.seq != o.seq {
+		return e.seq < o.seq
+	}
+	return e.id < o.id
+}
+
+// sharedQueue reports whether the queue spans replicas.
+func sharedQueue() bool {
+	return currentConfig().Coordination.Enabled
+}
+
+// enqueue puts an install in line. It starts at once if there is a free slot.
+func (q *provisionQueue) enqueue(id, host string, priority int, queuedAt time.Time) *queueEntry {
+	e := &queueEntry{id: id, host: host, priority: priority, queuedAt: queuedAt, ready: make(chan struct{})}
+	if sharedQueue() {
+		// pollShared creates the Lease again if this fails.
+		ctx, cancel := context.WithTimeout(context.Background(), queuePollInterval*5)
+		if err := createQueueLease(ctx, e); err != nil {
+			logger(ctx).Warn("adding to the shared queue failed", "operation", id, "err", err)
+		}
+		cancel()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	e.seq = q.seq
+	i := sort.Search(len(q.waiting), func(i int) bool { return e.before(q.waiting[i]) })
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = e
+	if sharedQueue() && !q.polling {
+		q.polling = true
+		go q.pollShared()
+	}
+	q.dispatch()
+	return e
+}
+
+// wait blocks until the entry has a slot and returns the function that gives
+// it back. If ctx ends first, the entry leaves the queue.
+func (q *provisionQueue) wait(ctx context.Context, e *queueEntry) (func(), error) {
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		q.drop(e)
+		return nil, ctx.Err()
+	}
+	queueWait.observe(e.started.Sub(e.queuedAt).Seconds())
+	var once sync.Once
+	return func() { once.Do(func() { q.release(e) }) }, nil
+}
+
+// drop takes an entry that will not wait for its slot out of the queue, or
+// gives back the slot it got meanwhile.
+func (q *provisionQueue) drop(e *queueEntry) {
+	q.mu.Lock()
+	for i, w := range q.waiting {
+		if w == e {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			deleteQueueLease(e)
+			return
+		}
+	}
+	q.mu.Unlock()
+	q.release(e)
+}
+
+func (q *provisionQueue) release(e *queueEntry) {
+	deleteQueueLease(e)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[e.host]--
+	if q.running[e.host] == 0 {
+		delete(q.running, e.host)
+	}
+	q.total--
+	q.estimate = (4*q.estimate + time.Since(e.started)) / 5
+	q.dispatch()
+}
+
+// dispatch starts waiting entries while there are free slots. The caller holds
+// q.mu. The shared queue is dispatched by the leader instead.
+func (q *provisionQueue) dispatch() {
+	if sharedQueue() {
+		return
+	}
+	admitted := admit(q.waiting, q.running, &q.total, currentConfig().Queue)
+	for _, e := range admitted {
+		q.remove(e)
+		e.started = time.Now()
+		close(e.ready)
+	}
+}
+
+// admit returns the entries of waiting, which is in queue order, that fit
+// into the free slots next to the running ones, and counts them as running.
+func admit(waiting []*queueEntry, running map[string]int, total *int, limits QueueConfig) []*queueEntry {
+	var admitted []*queueEntry
+	for _, e := range waiting {
+		if limits.MaxConcurrent > 0 && *total >= limits.MaxConcurrent {
+			break
+		}
+		if limits.MaxPerHost > 0 && running[e.host] >= limits.MaxPerHost {
+			continue
+		}
+		running[e.host]++
+		*total++
+		admitted = append(admitted, e)
+	}
+	return admitted
+}
+
+// remove takes e out of the waiting entries. The caller holds q.mu.
+func (q *provisionQueue) remove(e *queueEntry) {
+	for i, w := range q.waiting {
+		if w == e {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// limitsChanged starts the waiting entries that new queue limits make room
+// for.
+func (q *provisionQueue) limitsChanged() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dispatch()
+}
+
+// position returns the 1-based place of a waiting entry and a rough estimate
+// of when it will start.
+func (q *provisionQueue) position(id string) (int, time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := q.waiting
+	if sharedQueue() {
+		waiting = q.order
+	}
+	return q.place(waiting, id)
+}
+
+// place returns the 1-based place of id among waiting, which is in queue
+// order, and when it will start. The caller holds q.mu.
+func (q *provisionQueue) place(waiting []*queueEntry, id string) (int, time.Time, bool) {
+	limits := currentConfig().Queue
+	slots := limits.MaxConcurrent
+	if slots == 0 || (limits.MaxPerHost > 0 && limits.MaxPerHost < slots) {
+		slots = limits.MaxPerHost
+	}
+	if slots <= 0 {
+		slots = 1
+	}
+	for i, e := range waiting {
+		if e.id == id {
+			rounds := i/slots + 1
+			return i + 1, time.Now().Add(time.Duration(rounds) * q.estimate).Truncate(time.Second), true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+// placeShared reads the shared queue and sets the place of the queued
+// operations among infos, which may run on any replica.
+func (q *provisionQueue) placeShared(ctx context.Context, infos []OperationInfo) error {
+	entries, err := listQueueEntries(ctx)
+	if err != nil {
+		return err
+	}
+	var waiting []*queueEntry
+	for _, e := range entries {
+		if e.started.IsZero() {
+			waiting = append(waiting, e)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].before(waiting[j]) })
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range infos {
+		if infos[i].Stage != "queued" {
+			continue
+		}
+		if pos, eta, ok := q.place(waiting, infos[i].ID); ok {
+			infos[i].QueuePosition, infos[i].EstimatedStart = pos, &eta
+		}
+	}
+	return nil
+}
+
+// pollShared follows the shared queue while this replica has entries waiting
+// in it. It starts the entries the leader marked started, keeps the order of
+// all waiting entries for position, and adds the Leases of entries that are
+// missing, e.g. because creating them failed.
+func (q *provisionQueue) pollShared() {
+	for {
+		time.Sleep(queuePollInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), queuePollInterval*5)
+		entries, err := listQueueEntries(ctx)
+		cancel()
+
+		q.mu.Lock()
+		if len(q.waiting) == 0 {
+			q.polling, q.order = false, nil
+			q.mu.Unlock()
+			return
+		}
+		if err != nil {
+			q.mu.Unlock()
+			logger(ctx).Warn("reading the shared queue failed", "err", err)
+			continue
+		}
+		byID := map[string]*queueEntry{}
+		q.order = q.order[:0]
+		for _, e := range entries {
+			byID[e.id] = e
+			if e.started.IsZero() {
+				q.order = append(q.order, e)
+			}
+		}
+		sort.Slice(q.order, func(i, j int) bool { return q.order[i].before(q.order[j]) })
+		var missing []*queueEntry
+		for _, e := range append([]*queueEntry(nil), q.waiting...) {
+			shared, ok := byID[e.id]
+			switch {
+			case !ok:
+				missing = append(missing, e)
+			case !shared.started.IsZero():
+				q.remove(e)
+				q.running[e.host]++
+				q.total++
+				e.started = time.Now()
+				close(e.ready)
+			}
+		}
+		q.mu.Unlock()
+
+		for _, e := range missing {
+			ctx, cancel := context.WithTimeout(context.Background(), queuePollInterval*5)
+			if err := createQueueLease(ctx, e); err != nil {
+				logger(ctx).Warn("adding to the shared queue failed", "operation", e.id, "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// dispatchSharedQueue hands out the slots of the shared queue, for as long as
+// ctx lasts. It runs on the leader.
+func dispatchSharedQueue(ctx context.Context) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		if err := dispatchShared(ctx); err != nil {
+			logger(ctx).Warn("dispatching the shared queue failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchShared marks the waiting entries of the shared queue that fit into
+// the free slots as started. Entries of replicas that are gone are deleted;
+// the leader requeues their creates when it recovers their operations.
+func dispatchShared(ctx context.Context) error {
+	entries, err := listQueueEntries(ctx)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	alive, err := liveReplicas(ctx)
+	if err != nil {
+		return err
+	}
+	running := map[string]int{}
+	total := 0
+	var waiting []*queueEntry
+	for _, e := range entries {
+		switch {
+		case !alive[e.lease.Spec.HolderIdentity]:
+			if out, err := coordinationKubectl(ctx, nil, "delete", "lease", e.lease.Metadata.Name, "--ignore-not-found"); err != nil {
+				logger(ctx).Warn("deleting orphaned queue entry failed", "operation", e.id, "err", err, "output", string(out))
+			}
+		case !e.started.IsZero():
+			running[e.host]++
+			total++
+		default:
+			waiting = append(waiting, e)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].before(waiting[j]) })
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, e := range admit(waiting, running, &total, currentConfig().Queue) {
+		e.lease.Metadata.Annotations[annotationQueueStarted] = now
+		manifest, err := json.Marshal(e.lease)
+		if err != nil {
+			return err
+		}
+		// A conflict means the entry changed since it was read; the next
+		// round sees it again.
+		if out, err := coordinationKubectl(ctx, manifest, "replace", "-f", "-"); err != nil {
+			logger(ctx).Warn("starting queue entry failed", "operation", e.id, "err", err, "output", string(out))
+		}
+	}
+	return nil
+}
+
+// queueLeaseName returns the Lease of an entry. Operation IDs come from
+// clients, so the name is derived from a hash of the ID.
+func queueLeaseName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return queueLeasePrefix + hex.EncodeToString(sum[:10])
+}
+
+// createQueueLease adds an entry to the shared queue. An entry that is there
+// already is left alone.
+func createQueueLease(ctx context.Context, e *queueEntry) error {
+	var lease LeaseJSON
+	lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+	lease.Metadata.Name = queueLeaseName(e.id)
+	lease.Metadata.Labels = map[string]string{labelQueueLease: "true"}
+	lease.Metadata.Annotations = map[string]string{
+		annotationQueueID:       e.id,
+		annotationQueueHost:     e.host,
+		annotationQueuedAt:      e.queuedAt.Format(time.RFC3339Nano),
+		annotationQueuePriority: strconv.Itoa(e.priority),
+	}
+	lease.Spec.HolderIdentity = replicaID
+	manifest, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	if out, err := coordinationKubectl(ctx, manifest, "create", "-f", "-"); err != nil && !strings.Contains(string(out), "AlreadyExists") {
+		return fmt.Errorf("creating lease %s: %v, output: %s", lease.Metadata.Name, err, string(out))
+	}
+	return nil
+}
+
+// deleteQueueLease takes an entry that started or left out of the shared
+// queue.
+func deleteQueueLease(e *queueEntry) {
+	if !sharedQueue() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queuePollInterval*5)
+	defer cancel()
+	if out, err := coordinationKubectl(ctx, nil, "delete", "lease", queueLeaseName(e.id), "--ignore-not-found"); err != nil {
+		logger(ctx).Warn("removing from the shared queue failed", "operation", e.id, "err", err, "output", string(out))
+	}
+}
+
+// listQueueEntries reads the entries of the shared queue, each with its Lease.
+func listQueueEntries(ctx context.Context) ([]*queueEntry, error) {
+	out, err := coordinationKubectl(ctx, nil, "get", "leases", "-l", labelQueueLease+"=true", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("listing queue leases: %v, output: %s", err, string(out))
+	}
+	var list struct {
+		Items []LeaseJSON `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parsing queue leases: %v", err)
+	}
+	entries := make([]*queueEntry, 0, len(list.Items))
+	for _, lease := range list.Items {
+		annotations := lease.Metadata.Annotations
+		e := &queueEntry{id: annotations[annotationQueueID], host: annotations[annotationQueueHost], lease: lease}
+		e.priority, _ = strconv.Atoi(annotations[annotationQueuePriority])
+		e.queuedAt, _ = time.Parse(time.RFC3339Nano, annotations[annotationQueuedAt])
+		e.started, _ = time.Parse(time.RFC3339Nano, annotations[annotationQueueStarted])
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// queueAnnotations record on the namespace of a create that it waits in the
+// queue.
+func queueAnnotations(queuedAt time.Time, priority int) map[string]string {
+	return map[string]string{
+		annotationQueuedAt:      queuedAt.Format(time.RFC3339Nano),
+		annotationQueuePriority: strconv.Itoa(priority),
+	}
+}
+
+// dequeueCreate removes the queue record from the namespace of a create that
+// got its slot.
+func dequeueCreate(ctx context.Context, hostKubeconfig, clusterName string) {
+	if err := annotateNamespace(ctx, hostKubeconfig, clusterName, annotationQueuedAt+"-", annotationQueuePriority+"-"); err != nil {
+		logger(ctx).Warn("clearing queued create failed", "cluster", clusterName, "err", err)
+	}
+}
+
+func annotateNamespace(ctx context.Context, hostKubeconfig, clusterName string, annotations ...string) error {
+	args := append([]string{"annotate", "namespace", "vcluster-" + clusterName, "--overwrite"}, annotations...)
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	out, err := runCommand(ctx, exec.Command("kubectl", args...))
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// requeueCreate puts a create that was waiting when the backend stopped back
+// in line, at its original place, and installs it in the background. Its owner
+// fetches the kubeconfig once the cluster is up.
+func requeueCreate(ctx context.Context, hostKubeconfig string, ns NamespaceJSON, rec OperationInfo) {
+	annotations := ns.Metadata.Annotations
+	clusterName := strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+	queuedAt, err := time.Parse(time.RFC3339Nano, annotations[annotationQueuedAt])
+	if err != nil {
+		logger(ctx).Error("queued create has an invalid queue time", "cluster", clusterName, "err", err)
+		return
+	}
+	var params ClusterParams
+	if err := json.Unmarshal([]byte(annotations["kubehatch.io/params"]), &params); err != nil {
+		logger(ctx).Error("queued create has no valid parameters", "cluster", clusterName, "err", err)
+		return
+	}
+	if rec.ID == "" {
+		rec.ID, rec.User = newRequestID(""), annotations["kubehatch.io/owner"]
+	}
+	priority, _ := strconv.Atoi(annotations[annotationQueuePriority])
+	entry := provisioning.enqueue(rec.ID, hostLabel(hostKubeconfig), priority, queuedAt)
+	logger(ctx).Info("resuming queued create", "cluster", clusterName, "operation", rec.ID, "queued_at", queuedAt)
+	go resumeQueuedCreate(hostKubeconfig, clusterName, rec.User, params, entry)
+}
+
+func resumeQueuedCreate(hostKubeconfig, clusterName, owner string, params ClusterParams, entry *queueEntry) {
+	w, op, done := startBackgroundOperation(entry.id, "create", clusterName, owner)
+	defer done()
+	if !op.lockCluster(w, op.ctx) {
+		provisioning.drop(entry)
+		return
+	}
+	op.persistTo(hostKubeconfig)
+	ctx := op.setStage("render-config")
+
+	workingDir := filepath.Join(".", "requests", entry.id)
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
+		op.fail(w, fmt.Sprintf("Error creating working directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(workingDir)
+	if err := createVclusterYAML(workingDir, clusterName, params); err != nil {
+		op.fail(w, fmt.Sprintf("Error creating YAML: %v", err), http.StatusInternalServerError)
+		return
+	}
+	armCreateRollback(op, hostKubeconfig, clusterName, false)
+	if !installCluster(w, op, entry, workingDir, hostKubeconfig, clusterName, params) {
+		return
+	}
+	if _, ok := verifyCluster(w, op, workingDir, hostKubeconfig, clusterName, params); !ok {
+		return
+	}
+	logger(ctx).Info("resumed create finished, the owner can fetch a kubeconfig now", "cluster", clusterName, "owner", owner)
+}
+
+// queueGauge reports the installs waiting and running.
+type queueGauge struct{}
+
+func (queueGauge) writeTo(w io.Writer) {
+	provisioning.mu.Lock()
+	waiting, running := len(provisioning.waiting), provisioning.total
+	provisioning.mu.Unlock()
+	for _, g := range []struct {
+		name, help string
+		value      int
+	}{
+		{"kubehatch_queue_waiting", "Installs waiting for a slot.", waiting},
+		{"kubehatch_queue_running", "Installs holding a slot.", running},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdmit(t *testing.T) {
+	entry := func(id, host string) *queueEntry { return &queueEntry{id: id, host: host} }
+	tests := []struct {
+		name    string
+		limits  QueueConfig
+		running map[string]int
+		want    []string
+	}{
+		{"no limits", QueueConfig{}, map[string]int{"a": 5}, []string{"1", "2", "3", "4"}},
+		{"overall limit", QueueConfig{MaxConcurrent: 3}, map[string]int{"a": 1}, []string{"1", "2"}},
+		{"full host is skipped", QueueConfig{MaxPerHost: 1}, map[string]int{"a": 1}, []string{"2"}},
+		{"per host limit", QueueConfig{MaxPerHost: 2}, map[string]int{}, []string{"1", "2", "3", "4"}},
+		{"no free slot", QueueConfig{MaxConcurrent: 1}, map[string]int{"b": 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waiting := []*queueEntry{entry("1", "a"), entry("2", "b"), entry("3", "a"), entry("4", "b")}
+			total := 0
+			for _, n := range tt.running {
+				total += n
+			}
+			var got []string
+			for _, e := range admit(waiting, tt.running, &total, tt.limits) {
+				got = append(got, e.id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("admitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// crashLoopRestartLimit is how often a control-plane container may restart
+// while a create waits for it. The syncer commonly restarts a few times until
+// its backing store is up, so CrashLoopBackOff alone is not fatal here.
+const crashLoopRestartLimit = 5
+
+// watchRestartDelay is the pause before a pod watch that ended is restarted.
+const watchRestartDelay = 2 * time.Second
+
+// Bounds of the backoff between /readyz probes and vcluster connect attempts.
+const (
+	minReadyBackoff = time.Second
+	maxReadyBackoff = 10 * time.Second
+)
+
+// podWatchEvent is one line of kubectl get --watch --output-watch-events.
+type podWatchEvent struct {
+	Type   string  `json:"type"`
+	Object PodJSON `json:"object"`
+}
+
+// waitForControlPlane watches the control-plane pods of a new cluster and
+// returns as soon as replicas of them are ready. It fails early on container
+// states that will not resolve on their own.
+func waitForControlPlane(ctx context.Context, hostKubeconfig, clusterName string, replicas int) error {
+	pods := map[string]PodJSON{}
+	for {
+		done, err := watchControlPlanePods(ctx, hostKubeconfig, clusterName, replicas, pods)
+		if done || err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchRestartDelay):
+		}
+	}
+}
+
+// watchControlPlanePods runs a single pod watch, updating pods with every
+// event. It reports whether the control plane became ready; a watch that ends
+// without an error, e.g. at the server's watch timeout, is restarted by the
+// caller.
+func watchControlPlanePods(ctx context.Context, hostKubeconfig, clusterName string, replicas int, pods map[string]PodJSON) (bool, error) {
+	args := []string{"get", "pods", "-n", "vcluster-" + clusterName, "-l", "app=vcluster,release=" + clusterName,
+		"--watch", "--output-watch-events", "-o", "json"}
+	if hostKubeconfig != "" {
+		args = append([]string{"--kubeconfig", hostKubeconfig}, args...)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.Command("kubectl", args...)
+	stdout, pw := io.Pipe()
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = pw, &stderr
+	go func() {
+		start := time.Now()
+		span := startCommandSpan(ctx, cmd)
+		err := runIsolated(ctx, cmd)
+		observeCommand(ctx, cmd, start, span, err)
+		pw.CloseWithError(err)
+	}()
+	// Closing the reader makes kubectl's writes fail, should it outlive ctx.
+	defer stdout.Close()
+	defer cancel()
+
+	dec := json.NewDecoder(stdout)
+	for {
+		var ev podWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			logger(ctx).Debug("pod watch ended", "cluster", clusterName, "err", err, "output", strings.TrimSpace(stderr.String()))
+			return false, nil
+		}
+		if ev.Type == "DELETED" {
+			delete(pods, ev.Object.Metadata.Name)
+		} else {
+			pods[ev.Object.Metadata.Name] = ev.Object
+		}
+		ready, err := controlPlaneReady(pods)
+		if err != nil {
+			return false, err
+		}
+		if ready >= replicas {
+			logger(ctx).Debug("control plane pods ready", "cluster", clusterName, "ready", ready)
+			return true, nil
+		}
+	}
+}
+
+// controlPlaneReady counts the ready pods, or returns an error if one of them
+// is stuck.
+func controlPlaneReady(pods map[string]PodJSON) (int, error) {
+	ready := 0
+	for _, pod := range pods {
+		if pod.Status.Phase == "Failed" {
+			return 0, fmt.Errorf("pod %s failed: %s", pod.Metadata.Name, pod.Status.Message)
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			waiting := cs.State.Waiting
+			if waiting == nil || !fatalWaitingReasons[waiting.Reason] {
+				continue
+			}
+			if waiting.Reason == "CrashLoopBackOff" && cs.RestartCount < crashLoopRestartLimit {
+				continue
+			}
+			reason := waiting.Reason
+			if waiting.Message != "" {
+				reason += ": " + waiting.Message
+			}
+			return 0, fmt.Errorf("container %s in pod %s: %s (restarts: %d)", cs.Name, pod.Metadata.Name, reason, cs.RestartCount)
+		}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				ready++
+			}
+		}
+	}
+	return ready, nil
+}
+
+// readyzUnknownLimit is how many probes in a row may fail to reach the
+// virtual API server before the ready stage gives up.
+const readyzUnknownLimit = 6
+
+// waitForReadyz probes the virtual API server's /readyz through its
+// in-cluster service, as the health probe does, until it answers ok, backing
+// off between attempts. The kubeconfig handed to the user may point at an
+// address only reachable from elsewhere, such as the localhost port-forward
+// of vcluster connect, so it is not used here.
+func waitForReadyz(ctx context.Context, hostKubeconfig, clusterName string) error {
+	backoff := minReadyBackoff
+	unknown := 0
+	for attempt := 1; ; attempt++ {
+		cond := probeReadyz(ctx, hostKubeconfig, clusterName, "")
+		switch cond.Status {
+		case "True":
+			logger(ctx).Debug("virtual API server ready", "cluster", clusterName, "attempts", attempt)
+			return nil
+		case "Unknown":
+			if unknown++; unknown >= readyzUnknownLimit {
+				return fmt.Errorf("API server unreachable from the backend after %d attempts: %s %s", unknown, cond.Reason, cond.Message)
+			}
+		default:
+			unknown = 0
+		}
+		logger(ctx).Debug("virtual API server not ready", "cluster", clusterName, "attempt", attempt, "reason", cond.Reason)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v, last probe: %s %s", ctx.Err(), cond.Reason, cond.Message)
+		case <-time.After(backoff):
+		}
+		backoff = nextReadyBackoff(backoff)
+	}
+}
+
+func nextReadyBackoff(d time.Duration) time.Duration {
+	if d *= 2; d > maxReadyBackoff {
+		return maxReadyBackoff
+	}
+	return d
+}
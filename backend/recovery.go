@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A create, update or delete records itself, with its current stage and
+// replica, on the namespace of its cluster until it finishes. Operations whose
+// replica is gone are picked up again under their old IDs: at startup without
+// coordination, else by the leader. Queued creates go back in line, creates
+// whose control plane exists carry on, other creates fail according to
+// failedClusters.policy, and updates and deletes run again.
+
+// annotationOperation holds the OperationInfo of the operation in flight.
+const annotationOperation = "kubehatch.io/operation"
+
+// annotationCancelRequested holds the ID of a recorded operation that a
+// replica other than its own was asked to cancel.
+const annotationCancelRequested = "kubehatch.io/cancel-requested"
+
+// cancelPollInterval is how often a replica looks for cancel requests for
+// its operations.
+const cancelPollInterval = 5 * time.Second
+
+// persistTimeout bounds recording an operation's stage on its namespace.
+const persistTimeout = 10 * time.Second
+
+// record returns the operation as stored on the namespace.
+func (op *operation) record() string {
+	data, _ := json.Marshal(OperationInfo{
+		ID:        op.id,
+		Operation: op.name,
+		Cluster:   op.cluster,
+		User:      op.user,
+		Stage:     op.currentStage(),
+		StartedAt: op.start,
+		Replica:   op.replica,
+	})
+	return string(data)
+}
+
+// persistTo makes every following stage of the operation be recorded on the
+// namespace of its cluster, and the record be removed when it finishes.
+func (op *operation) persistTo(hostKubeconfig string) {
+	op.persistHost, op.persisted = hostKubeconfig, true
+}
+
+func (op *operation) persistStage(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, persistTimeout)
+	defer cancel()
+	if err := annotateNamespace(ctx, op.persistHost, op.cluster, annotationOperation+"="+op.record()); err != nil {
+		logger(ctx).Warn("recording operation stage failed", "operation", op.id, "cluster", op.cluster, "err", err)
+	}
+}
+
+// disown records the operation without a replica, for the next recovery pass
+// to pick it up again, and stops recording it.
+func (op *operation) disown(ctx context.Context) {
+	op.replica = ""
+	op.persistStage(ctx)
+	op.persisted = false
+}
+
+// disownIfRecorded disowns an operation that lost its cluster lock, so that
+// the leader resumes it, unless its record names another operation or
+// replica by now.
+func (op *operation) disownIfRecorded() {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(op.ctx), persistTimeout)
+	defer cancel()
+	ns, err := getClusterNamespace(ctx, op.persistHost, op.cluster)
+	if err != nil {
+		logger(ctx).Warn("reading operation record failed", "operation", op.id, "cluster", op.cluster, "err", err)
+		return
+	}
+	var rec OperationInfo
+	if err := json.Unmarshal([]byte(ns.Metadata.Annotations[annotationOperation]), &rec); err != nil || rec.ID != op.id || rec.Replica != replicaID {
+		return
+	}
+	op.replica = ""
+	// The resource version makes this fail if the record changed meanwhile.
+	if err := annotateNamespace(ctx, op.persistHost, op.cluster, "--resource-version="+ns.Metadata.ResourceVersion, annotationOperation+"="+op.record()); err != nil {
+		logger(ctx).Warn("disowning operation failed", "operation", op.id, "cluster", op.cluster, "err", err)
+	}
+}
+
+func (op *operation) unpersist() {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(op.ctx), persistTimeout)
+	defer cancel()
+	if err := annotateNamespace(ctx, op.persistHost, op.cluster, annotationOperation+"-", annotationCancelRequested+"-"); err != nil {
+		// The cluster is gone after a delete, or a failed create under the
+		// delete policy.
+		logger(ctx).Debug("removing operation record failed", "operation", op.id, "cluster", op.cluster, "err", err)
+	}
+}
+
+// recordedOperations returns the operations recorded on the default host,
+// by any replica.
+func recordedOperations(ctx context.Context) ([]OperationInfo, error) {
+	namespaces, err := listVclusterNamespaces(ctx, getDefaultKubeconfig())
+	if err != nil {
+		return nil, err
+	}
+	var records []OperationInfo
+	for _, ns := range namespaces {
+		data, ok := ns.Metadata.Annotations[annotationOperation]
+		if !ok {
+			continue
+		}
+		var rec OperationInfo
+		if err := json.Unmarshal([]byte(data), &rec); err != nil || rec.ID == "" {
+			continue
+		}
+		rec.Cluster = strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// requestCancel asks the replica that runs a recorded operation to cancel it.
+func requestCancel(ctx context.Context, rec OperationInfo) error {
+	return annotateNamespace(ctx, getDefaultKubeconfig(), rec.Cluster, annotationCancelRequested+"="+rec.ID)
+}
+
+// watchCancelRequests cancels the operations of this replica that were
+// cancelled through another replica. A disowned operation is cancelled by the
+// replica that resumes it.
+func watchCancelRequests() {
+	for {
+		time.Sleep(cancelPollInterval)
+		operationsMu.Lock()
+		idle := len(operations) == 0
+		operationsMu.Unlock()
+		if idle {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cancelPollInterval)
+		namespaces, err := listVclusterNamespaces(ctx, getDefaultKubeconfig())
+		cancel()
+		if err != nil {
+			logger(ctx).Warn("looking for cancel requests failed", "err", err)
+			continue
+		}
+		for _, ns := range namespaces {
+			id := ns.Metadata.Annotations[annotationCancelRequested]
+			if id == "" {
+				continue
+			}
+			operationsMu.Lock()
+			op, ok := operations[id]
+			operationsMu.Unlock()
+			if ok && op.ctx.Err() == nil {
+				logger(op.ctx).Info("operation cancel requested through another replica", "operation", id, "cluster", op.cluster)
+				op.cancel(errOperationCancelled)
+			}
+		}
+	}
+}
+
+// recoverOperations picks up the unfinished operations whose replica is not
+// among alive. A nil alive means this is the only replica, so every operation
+// it does not run itself is orphaned.
+func recoverOperations(ctx context.Context, alive map[string]bool) {
+	hostKubeconfig := getDefaultKubeconfig()
+	namespaces, err := listVclusterNamespaces(ctx, hostKubeconfig)
+	if err != nil {
+		logger(ctx).Warn("listing unfinished operations failed", "err", err)
+		return
+	}
+	for _, ns := range namespaces {
+		annotations := ns.Metadata.Annotations
+		var rec OperationInfo
+		if data, ok := annotations[annotationOperation]; ok {
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				logger(ctx).Error("invalid operation record", "namespace", ns.Metadata.Name, "err", err)
+				continue
+			}
+		}
+		rec.Cluster = strings.TrimPrefix(ns.Metadata.Name, "vcluster-")
+		operationsMu.Lock()
+		_, running := operations[rec.ID]
+		operationsMu.Unlock()
+		if running || (alive != nil && alive[rec.Replica]) {
+			continue
+		}
+		switch {
+		case rec.Operation == "delete":
+			logger(ctx).Info("resuming delete", "cluster", rec.Cluster, "operation", rec.ID)
+			go recoverDelete(hostKubeconfig, rec)
+		case ns.Status.Phase == "Terminating":
+		case annotations[annotationQueuedAt] != "":
+			requeueCreate(ctx, hostKubeconfig, ns, rec)
+		case rec.Operation == "update":
+			logger(ctx).Info("resuming update", "cluster", rec.Cluster, "operation", rec.ID)
+			go recoverUpdate(hostKubeconfig, ns, rec)
+		case rec.Operation == "create":
+			logger(ctx).Info("resuming create", "cluster", rec.Cluster, "operation", rec.ID, "stage", rec.Stage)
+			go recoverCreate(hostKubeconfig, ns, rec)
+		}
+	}
+}
+
+// recoverCreate continues a create that was interrupted after its install
+// started, if its control plane exists. Its owner fetches the kubeconfig once
+// the cluster is up.
+func recoverCreate(hostKubeconfig string, ns NamespaceJSON, rec OperationInfo) {
+	w, op, done := startBackgroundOperation(rec.ID, "create", rec.Cluster, rec.User)
+	defer done()
+	if !op.lockCluster(w, op.ctx) {
+		return
+	}
+	op.persistTo(hostKubeconfig)
+	ctx := op.setStage(rec.Stage)
+
+	var params ClusterParams
+	if err := json.Unmarshal([]byte(ns.Metadata.Annotations["kubehatch.io/params"]), &params); err != nil {
+		op.fail(w, fmt.Sprintf("Cluster has no valid parameters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// If the host cannot be inspected, the next recovery pass tries again.
+	pods, err := getControlPlanePods(ctx, hostKubeconfig, rec.Cluster)
+	if err != nil {
+		op.disown(ctx)
+		op.fail(w, fmt.Sprintf("Error inspecting the control plane: %v", err), http.StatusInternalServerError)
+		return
+	}
+	armCreateRollback(op, hostKubeconfig, rec.Cluster, false)
+	if len(pods) == 0 {
+		op.fail(w, fmt.Sprintf("Backend restarted during stage %s before the control plane was installed", rec.Stage), http.StatusInternalServerError)
+		return
+	}
+
+	if params.Exposure == ExposureIngress && (rec.Stage == "install" || rec.Stage == "expose") {
+		ctx = op.setStage("expose")
+		if err := applyIngress(ctx, hostKubeconfig, rec.Cluster); err != nil {
+			op.fail(w, fmt.Sprintf("Error exposing virtual cluster: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !awaitControlPlane(w, op, hostKubeconfig, rec.Cluster, params) {
+		return
+	}
+	workingDir := filepath.Join(".", "requests", rec.ID)
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
+		op.fail(w, fmt.Sprintf("Error creating working directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(workingDir)
+	if _, ok := verifyCluster(w, op, workingDir, hostKubeconfig, rec.Cluster, params); !ok {
+		return
+	}
+	if owner := ns.Metadata.Annotations["kubehatch.io/owner"]; owner != rec.User {
+		if err := annotateNamespace(op.ctx, hostKubeconfig, rec.Cluster, "kubehatch.io/owner="+rec.User); err != nil {
+			op.fail(w, fmt.Sprintf("Cluster is up but setting its owner failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditEvent(op.ctx, auditSystemActor, AuditOwnershipChange, rec.Cluster, map[string]interface{}{"from": owner, "to": rec.User, "operation": rec.ID})
+	}
+	logger(ctx).Info("resumed create finished, the owner can fetch a kubeconfig now", "cluster", rec.Cluster, "owner", rec.User)
+}
+
+// recoverDelete runs an interrupted delete again. If it fails, the next
+// recovery pass tries again.
+func recoverDelete(hostKubeconfig string, rec OperationInfo) {
+	w, op, done := startBackgroundOperation(rec.ID, "delete", rec.Cluster, rec.User)
+	defer done()
+	if !op.lockCluster(w, op.ctx) {
+		return
+	}
+	op.persistTo(hostKubeconfig)
+	ctx := op.setStage("uninstall")
+	if err := rollbackCreate(ctx, hostKubeconfig, rec.Cluster); err != nil {
+		op.disown(ctx)
+		op.fail(w, fmt.Sprintf("Error deleting vcluster: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger(ctx).Info("deleted cluster", "cluster", rec.Cluster)
+}
+
+// recoverUpdate upgrades a cluster again to the parameters stored on it, which
+// an interrupted update set to its target before upgrading. If it fails, the
+// parameters are left as they are for the owner to retry.
+func recoverUpdate(hostKubeconfig string, ns NamespaceJSON, rec OperationInfo) {
+	w, op, done := startBackgroundOperation(rec.ID, "update", rec.Cluster, rec.User)
+	defer done()
+	if !op.lockCluster(w, op.ctx) {
+		return
+	}
+	op.persistTo(hostKubeconfig)
+
+	var params ClusterParams
+	if err := json.Unmarshal([]byte(ns.Metadata.Annotations["kubehatch.io/params"]), &params); err != nil {
+		op.fail(w, fmt.Sprintf("Cluster has no valid parameters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if updateCluster(w, op, hostKubeconfig, rec.Cluster, params, params) {
+		logger(op.ctx).Info("resumed update finished", "cluster", rec.Cluster)
+	}
+}
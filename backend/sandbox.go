@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every kubectl and vcluster subprocess gets its own empty HOME and XDG
+// directories, so the CLIs' global state (~/.vcluster/config.json, ~/.kube
+// caches, contexts written by vcluster connect) cannot leak between concurrent
+// requests or users. Only the variables below are inherited; anything else in
+// the backend's environment, such as KUBEHATCH_DOWNLOAD_SIGNING_KEY, stays out.
+var passthroughEnv = []string{
+	"PATH", "TZ", "LANG",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	// In-cluster configuration, unless the caller filtered it out.
+	"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT", "KUBERNETES_PORT",
+	"KUBECONFIG",
+}
+
+// commandWaitDelay bounds how long a finished or killed command may keep its
+// output pipes open through leftover child processes.
+const commandWaitDelay = 5 * time.Second
+
+// isolateCommand gives cmd a minimal environment, built from cmd.Env if the
+// caller set one and the backend's environment otherwise, and a fresh
+// temporary HOME. It returns the directory, which the caller must remove once
+// the command has exited.
+func isolateCommand(cmd *exec.Cmd) (string, error) {
+	home, err := os.MkdirTemp("", "kubehatch-home-")
+	if err != nil {
+		return "", fmt.Errorf("creating command home: %v", err)
+	}
+	base := cmd.Env
+	if base == nil {
+		base = os.Environ()
+	}
+	env := []string{
+		"HOME=" + home,
+		"XDG_CONFIG_HOME=" + filepath.Join(home, ".config"),
+		"XDG_CACHE_HOME=" + filepath.Join(home, ".cache"),
+		"XDG_DATA_HOME=" + filepath.Join(home, ".local", "share"),
+		"XDG_STATE_HOME=" + filepath.Join(home, ".local", "state"),
+	}
+	for _, e := range base {
+		for _, key := range passthroughEnv {
+			if strings.HasPrefix(e, key+"=") {
+				env = append(env, e)
+				break
+			}
+		}
+	}
+	cmd.Env = env
+	// Run in its own process group so that cancelling also stops anything the
+	// CLI spawned, e.g. helm or port-forwards.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = commandWaitDelay
+	return home, nil
+}
+
+// runIsolated runs cmd in its own HOME and waits for it. The process group is
+// killed when ctx is done or after timeouts.command, and the temporary HOME is
+// removed in every case.
+func runIsolated(ctx context.Context, cmd *exec.Cmd) error {
+	home, err := isolateCommand(cmd)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Timeouts.Command.Duration)
+	defer cancel()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	if !stop() && err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%v: %w", ctx.Err(), err)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useConfig makes cfg the active configuration for the rest of the test.
+func useConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	prev := activeConfig.Load()
+	activeConfig.Store(cfg)
+	t.Cleanup(func() { activeConfig.Store(prev) })
+}
+
+// TestRunIsolatedConcurrent runs commands side by side that each write their
+// own state to ~/.vcluster, as vcluster connect does, and checks that none of
+// them sees another's state or the backend's environment.
+func TestRunIsolatedConcurrent(t *testing.T) {
+	useConfig(t, defaultConfig())
+	t.Setenv("KUBEHATCH_DOWNLOAD_SIGNING_KEY", "secret")
+	t.Setenv("HTTPS_PROXY", "http://proxy:3128")
+
+	const runs = 16
+	script := `mkdir -p "$HOME/.vcluster" && echo "$1" > "$HOME/.vcluster/config.json" && sleep 0.2 &&
+		echo "$HOME $(cat "$HOME/.vcluster/config.json") key=$KUBEHATCH_DOWNLOAD_SIGNING_KEY proxy=$HTTPS_PROXY"`
+	outputs := make([]string, runs)
+	errs := make([]error, runs)
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := runCommandOutput(context.Background(), exec.Command("sh", "-c", script, "sh", fmt.Sprint(i)))
+			outputs[i], errs[i] = strings.TrimSpace(string(out)), err
+		}()
+	}
+	wg.Wait()
+
+	homes := map[string]bool{}
+	for i, out := range outputs {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %v", i, errs[i])
+		}
+		fields := strings.Fields(out)
+		if len(fields) != 4 {
+			t.Fatalf("run %d printed %q", i, out)
+		}
+		home, state, key, proxy := fields[0], fields[1], fields[2], fields[3]
+		if state != fmt.Sprint(i) {
+			t.Errorf("run %d read state %q written by another run", i, state)
+		}
+		if homes[home] {
+			t.Errorf("run %d shares HOME %s with another run", i, home)
+		}
+		homes[home] = true
+		if key != "key=" {
+			t.Errorf("run %d saw the backend's signing key: %s", i, key)
+		}
+		if proxy != "proxy=http://proxy:3128" {
+			t.Errorf("run %d did not inherit HTTPS_PROXY: %s", i, proxy)
+		}
+		if _, err := os.Stat(home); !os.IsNotExist(err) {
+			t.Errorf("run %d left its HOME %s behind (stat: %v)", i, home, err)
+		}
+	}
+}
+
+// TestRunIsolatedCancel checks that cancelling a command also stops the
+// processes it started.
+func TestRunIsolatedCancel(t *testing.T) {
+	useConfig(t, defaultConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runCommand(ctx, exec.Command("sh", "-c", "sleep 30 & sleep 30"))
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("runCommand() error = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runCommand() returned after %s, want the process group killed promptly", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM the backend stops taking requests and hands its work over. The
+// operations in flight stop without rolling back and are recorded without a
+// replica, so that the leader, or this backend after a restart, resumes them.
+// Their cluster locks, the leader Lease and the heartbeat Lease are released,
+// so that another replica can take over at once.
+
+// errShuttingDown is the cancel cause of operations stopped by a shutdown.
+var errShuttingDown = errors.New("stopped by a backend shutdown")
+
+// shutdownTimeout bounds the handover, within the default termination grace
+// period of a pod.
+const shutdownTimeout = 25 * time.Second
+
+// shutdownOnTerm shuts srv down on SIGTERM or SIGINT. The returned channel is
+// closed once the handover is done.
+func shutdownOnTerm(srv *http.Server) <-chan struct{} {
+	stopped := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-term
+		rootLogger.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		// No more leader loops, so no more recoveries.
+		stopBackground()
+		serverDone := make(chan error, 1)
+		go func() { serverDone <- srv.Shutdown(ctx) }()
+		stopOperations(ctx)
+		if err := <-serverDone; err != nil {
+			rootLogger.Warn("closing connections failed", "err", err)
+		}
+		releaseReplicaLeases(ctx)
+		tracer.shutdown(ctx)
+		close(stopped)
+	}()
+	return stopped
+}
+
+// stopOperations cancels the operations, including those without a request
+// and those that start meanwhile, until none is left or ctx ends.
+func stopOperations(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		operationsMu.Lock()
+		left := len(operations)
+		for _, op := range operations {
+			op.cancel(errShuttingDown)
+		}
+		operationsMu.Unlock()
+		if left == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			rootLogger.Warn("operations still running at shutdown", "operations", left)
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing exports spans over OTLP/HTTP with JSON encoding, which any
+// OpenTelemetry collector accepts on its HTTP receiver (port 4318 by
+// default). It is configured with the standard variables:
+//
+//	OTEL_SDK_DISABLED                     "true" turns tracing off
+//	OTEL_TRACES_EXPORTER                  "otlp" (default when an endpoint is set) or "none"
+//	OTEL_EXPORTER_OTLP_ENDPOINT           base URL; /v1/traces is appended
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT    full URL of the traces endpoint
+//	OTEL_EXPORTER_OTLP_[TRACES_]HEADERS   key=value,... sent with each export
+//	OTEL_EXPORTER_OTLP_[TRACES_]TIMEOUT   export timeout in milliseconds
+//	OTEL_SERVICE_NAME                     service.name (default kubehatch-backend)
+//	OTEL_RESOURCE_ATTRIBUTES              key=value,... resource attributes
+//	OTEL_TRACES_SAMPLER[_ARG]             always_on, always_off, traceidratio and parentbased_* variants
+//
+// Only the http/json protocol is implemented. Incoming and outgoing requests
+// use W3C trace context (traceparent).
+
+// Span kinds as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 2048
+	traceFlushInterval = 5 * time.Second
+)
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+func attrString(key, value string) attribute    { return attribute{key, value} }
+func attrInt(key string, value int) attribute   { return attribute{key, value} }
+func attrBool(key string, value bool) attribute { return attribute{key, value} }
+
+// Span is one timed operation in a trace. Methods are no-ops on spans that
+// are not sampled, so callers never need to check.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	mu        sync.Mutex
+	name      string
+	kind      int
+	start     time.Time
+	attrs     []attribute
+	status    int
+	statusMsg string
+	ended     bool
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the current span, or nil.
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// startSpan starts a child of the span in ctx, or a new trace.
+func startSpan(ctx context.Context, name string, kind int, attrs ...attribute) (context.Context, *Span) {
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	parent := spanFromContext(ctx)
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = tracer.sampleRoot(span.traceID)
+	}
+	if parent != nil && tracer.ignoreParent {
+		span.sampled = tracer.sampleRoot(span.traceID)
+	}
+	span.sampled = span.sampled && tracer.enabled
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...attribute) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || !s.sampled || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status, s.statusMsg = spanStatusError, err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parentID != ([8]byte{}) {
+		data.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != 0 {
+		data.Status = &otlpStatus{Code: s.status, Message: s.statusMsg}
+	}
+	s.mu.Unlock()
+	tracer.enqueue(data)
+}
+
+// extractTraceContext returns ctx with the remote parent from a traceparent
+// header, if the header is valid.
+func extractTraceContext(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	remote := &Span{}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil || remote.traceID == ([16]byte{}) {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil || remote.spanID == ([8]byte{}) {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanContextKey{}, remote)
+}
+
+// injectTraceContext sets the traceparent header for the span in ctx.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	span := spanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(span.traceID[:]), hex.EncodeToString(span.spanID[:]), flags))
+}
+
+// OTLP JSON payload types.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs []attribute) []otlpAttribute {
+	var out []otlpAttribute
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch val := a.value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		out = append(out, otlpAttribute{Key: a.key, Value: v})
+	}
+	return out
+}
+
+// traceExporter batches finished spans and posts them to the collector.
+type traceExporter struct {
+	enabled      bool
+	endpoint     string
+	headers      map[string]string
+	client       *http.Client
+	resource     []otlpAttribute
+	ratio        float64
+	ignoreParent bool
+	queue        chan otlpSpan
+	// flush asks run to export what is queued and close the channel it
+	// sends.
+	flush chan chan struct{}
+}
+
+var tracer = newTraceExporter()
+
+func newTraceExporter() *traceExporter {
+	t := &traceExporter{ratio: 1}
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return t
+	}
+	t.endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if t.endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			t.endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		} else if os.Getenv("OTEL_TRACES_EXPORTER") == "otlp" {
+			t.endpoint = "http://localhost:4318/v1/traces"
+		} else {
+			return t
+		}
+	}
+	protocol := firstEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL")
+	if protocol != "" && protocol != "http/json" {
+		rootLogger.Warn("OTLP protocol not supported, exporting traces as http/json", "protocol", protocol)
+	}
+
+	timeout := 10 * time.Second
+	if ms, err := strconv.Atoi(firstEnv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	t.client = &http.Client{Timeout: timeout}
+	t.headers = parseKeyValues(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for k, v := range parseKeyValues(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		t.headers[k] = v
+	}
+
+	resource := parseKeyValues(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["service.name"] = name
+	} else if resource["service.name"] == "" {
+		resource["service.name"] = "kubehatch-backend"
+	}
+	for k, v := range resource {
+		t.resource = append(t.resource, otlpAttribute{Key: k, Value: map[string]interface{}{"stringValue": v}})
+	}
+
+	arg, _ := strconv.ParseFloat(os.Getenv("OTEL_TRACES_SAMPLER_ARG"), 64)
+	switch os.Getenv("OTEL_TRACES_SAMPLER") {
+	case "always_on":
+		t.ignoreParent = true
+	case "always_off":
+		t.ratio, t.ignoreParent = 0, true
+	case "traceidratio":
+		t.ratio, t.ignoreParent = arg, true
+	case "parentbased_always_off":
+		t.ratio = 0
+	case "parentbased_traceidratio":
+		t.ratio = arg
+	}
+
+	t.enabled = true
+	t.queue = make(chan otlpSpan, traceQueueSize)
+	t.flush = make(chan chan struct{})
+	go t.run()
+	rootLogger.Info("exporting traces", "endpoint", t.endpoint)
+	return t
+}
+
+// sampleRoot decides whether a trace without a sampled parent is recorded,
+// using the low bytes of the trace ID as in the traceidratio sampler.
+func (t *traceExporter) sampleRoot(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(t.ratio*(1<<63))
+}
+
+func (t *traceExporter) enqueue(span otlpSpan) {
+	if !t.enabled {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		// Never block a request on telemetry.
+	}
+}
+
+func (t *traceExporter) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			if len(batch) > 0 {
+				t.export(batch)
+				batch = nil
+			}
+			close(done)
+			continue
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// shutdown exports the spans that are still queued, or gives up when ctx
+// ends.
+func (t *traceExporter) shutdown(ctx context.Context) {
+	if !t.enabled {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (t *traceExporter) export(spans []otlpSpan) {
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": t.resource},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "kubehatch"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		rootLogger.Error("encoding spans failed", "err", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		rootLogger.Error("exporting spans failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		rootLogger.Error("exporting spans failed", "spans", len(spans), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		rootLogger.Error("exporting spans failed", "spans", len(spans), "status", resp.Status)
+	}
+}
+
+// parseKeyValues parses the key1=value1,key2=value2 format of the OTEL_*
+// variables; values are URL-decoded.
+func parseKeyValues(raw string) map[string]string {
+	result := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			continue
+		}
+		if decoded, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = decoded
+		}
+		result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return result
+}
+
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maxUploadedKubeconfigSize bounds an uploaded host kubeconfig.
+const maxUploadedKubeconfigSize = 1 << 20
+
+// Uploaded host kubeconfigs are passed to kubectl and vcluster inside the
+// backend container, so anything that makes those run a program or read a
+// local file is rejected. The types below list the fields that are kept;
+// everything else lands in Other and is refused unless it is known to be
+// harmless.
+
+type uploadedKubeconfig struct {
+	APIVersion     string `yaml:"apiVersion"`
+	Kind           string `yaml:"kind"`
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string          `yaml:"name"`
+		Cluster uploadedCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string          `yaml:"name"`
+		Context uploadedContext `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string       `yaml:"name"`
+		User uploadedUser `yaml:"user"`
+	} `yaml:"users"`
+}
+
+type uploadedCluster struct {
+	Server                   string                 `yaml:"server"`
+	CertificateAuthorityData string                 `yaml:"certificate-authority-data,omitempty"`
+	InsecureSkipTLSVerify    bool                   `yaml:"insecure-skip-tls-verify,omitempty"`
+	TLSServerName            string                 `yaml:"tls-server-name,omitempty"`
+	Other                    map[string]interface{} `yaml:",inline"`
+}
+
+type uploadedContext struct {
+	Cluster   string                 `yaml:"cluster"`
+	User      string                 `yaml:"user"`
+	Namespace string                 `yaml:"namespace,omitempty"`
+	Other     map[string]interface{} `yaml:",inline"`
+}
+
+type uploadedUser struct {
+	Token                 string                 `yaml:"token,omitempty"`
+	ClientCertificateData string                 `yaml:"client-certificate-data,omitempty"`
+	ClientKeyData         string                 `yaml:"client-key-data,omitempty"`
+	Username              string                 `yaml:"username,omitempty"`
+	Password              string                 `yaml:"password,omitempty"`
+	Exec                  *uploadedExec          `yaml:"exec,omitempty"`
+	Other                 map[string]interface{} `yaml:",inline"`
+}
+
+type uploadedExec struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args,omitempty"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env,omitempty"`
+	InteractiveMode    string                 `yaml:"interactiveMode,omitempty"`
+	ProvideClusterInfo bool                   `yaml:"provideClusterInfo,omitempty"`
+	Other              map[string]interface{} `yaml:",inline"`
+}
+
+// fileReferenceFields point kubectl at files on the backend's filesystem.
+var fileReferenceFields = map[string]string{
+	"certificate-authority": "certificate-authority-data",
+	"client-certificate":    "client-certificate-data",
+	"client-key":            "client-key-data",
+	"tokenFile":             "token",
+}
+
+// ignoredFields carry no behaviour kubectl acts on and are dropped.
+var ignoredFields = map[string]bool{"extensions": true}
+
+// checkOtherFields rejects the fields of a cluster, context or user that are
+// not explicitly supported.
+func checkOtherFields(kind, name string, other map[string]interface{}) error {
+	keys := make([]string, 0, len(other))
+	for k := range other {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch {
+		case ignoredFields[k]:
+		case k == "auth-provider":
+			return fmt.Errorf("%s %q uses an auth-provider, which is not allowed; use a token or client certificate", kind, name)
+		case fileReferenceFields[k] != "":
+			return fmt.Errorf("%s %q references a local file in %s; embed it as %s instead", kind, name, k, fileReferenceFields[k])
+		default:
+			return fmt.Errorf("%s %q has unsupported field %s", kind, name, k)
+		}
+	}
+	return nil
+}
+
+// execAllowed reports whether an entry of uploads.allowedExecCommands, a
+// command followed by the arguments the plugin's args must start with, allows
+// running command with args.
+func execAllowed(entry, command string, args []string) bool {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || fields[0] != command || len(args) < len(fields)-1 {
+		return false
+	}
+	for i, arg := range fields[1:] {
+		if args[i] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// checkExec allows an exec credential plugin only if its command and leading
+// arguments match an entry of uploads.allowedExecCommands.
+func checkExec(userName string, e *uploadedExec) error {
+	if err := checkOtherFields("exec plugin of user", userName, e.Other); err != nil {
+		return err
+	}
+	allowed := false
+	for _, entry := range currentConfig().Uploads.AllowedExecCommands {
+		if execAllowed(entry, e.Command, e.Args) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("user %q uses exec credential plugin %q, which is not allowed; use a token or client certificate", userName, strings.Join(append([]string{e.Command}, e.Args...), " "))
+	}
+	for _, env := range e.Env {
+		if env.Name == "PATH" || strings.HasPrefix(env.Name, "LD_") {
+			return fmt.Errorf("user %q: exec plugin may not set %s", userName, env.Name)
+		}
+	}
+	return nil
+}
+
+// sanitizeUploadedKubeconfig validates an uploaded host kubeconfig and returns
+// a copy holding only its current context (or its only context) with that
+// context's cluster and user.
+func sanitizeUploadedKubeconfig(data []byte) ([]byte, error) {
+	var kc uploadedKubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("not a valid kubeconfig: %v", err)
+	}
+
+	contextName := kc.CurrentContext
+	if contextName == "" {
+		if len(kc.Contexts) != 1 {
+			return nil, errors.New("kubeconfig has no current-context; set one or upload a kubeconfig with a single context")
+		}
+		contextName = kc.Contexts[0].Name
+	}
+	out := uploadedKubeconfig{APIVersion: "v1", Kind: "Config", CurrentContext: contextName}
+
+	for _, c := range kc.Contexts {
+		if c.Name == contextName {
+			out.Contexts = append(out.Contexts, c)
+		}
+	}
+	if len(out.Contexts) != 1 {
+		return nil, fmt.Errorf("kubeconfig must define context %q exactly once", contextName)
+	}
+	kctx := &out.Contexts[0].Context
+	if err := checkOtherFields("context", contextName, kctx.Other); err != nil {
+		return nil, err
+	}
+	kctx.Other = nil
+
+	for _, c := range kc.Clusters {
+		if c.Name == kctx.Cluster {
+			out.Clusters = append(out.Clusters, c)
+		}
+	}
+	if len(out.Clusters) != 1 {
+		return nil, fmt.Errorf("kubeconfig must define cluster %q exactly once", kctx.Cluster)
+	}
+	cluster := &out.Clusters[0].Cluster
+	if err := checkOtherFields("cluster", kctx.Cluster, cluster.Other); err != nil {
+		return nil, err
+	}
+	cluster.Other = nil
+	if u, err := url.Parse(cluster.Server); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("cluster %q: server must be an https URL", kctx.Cluster)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name == kctx.User {
+			out.Users = append(out.Users, u)
+		}
+	}
+	if len(out.Users) != 1 {
+		return nil, fmt.Errorf("kubeconfig must define user %q exactly once", kctx.User)
+	}
+	user := &out.Users[0].User
+	if err := checkOtherFields("user", kctx.User, user.Other); err != nil {
+		return nil, err
+	}
+	user.Other = nil
+	if user.Exec != nil {
+		if err := checkExec(kctx.User, user.Exec); err != nil {
+			return nil, err
+		}
+		user.Exec.Other = nil
+	}
+
+	return yaml.Marshal(out)
+}
+
+// saveUploadedKubeconfig validates the uploaded host kubeconfig, writes the
+// sanitized copy into workingDir and checks that its API server answers. It
+// returns the absolute path of the saved file.
+func saveUploadedKubeconfig(ctx context.Context, upload io.Reader, workingDir string) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(upload, maxUploadedKubeconfigSize+1))
+	if err != nil {
+		return "", fmt.Errorf("reading uploaded kubeconfig: %v", err)
+	}
+	if len(data) > maxUploadedKubeconfigSize {
+		return "", errors.New("uploaded kubeconfig is larger than 1 MiB")
+	}
+	sanitized, err := sanitizeUploadedKubeconfig(data)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(workingDir, "uploaded.yaml"))
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, sanitized, 0600); err != nil {
+		return "", fmt.Errorf("saving uploaded kubeconfig: %v", err)
+	}
+
+	cmd := exec.Command("kubectl", "--kubeconfig", path, "--request-timeout=10s", "get", "--raw", "/version")
+	cmd.Env = filterEnv(os.Environ(), []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT", "KUBERNETES_PORT"})
+	if out, err := runCommand(ctx, cmd); err != nil {
+		return "", fmt.Errorf("host cluster from the uploaded kubeconfig is not reachable: %s", lastLine(out, err))
+	}
+	return path, nil
+}
+
+// lastLine returns the last non-empty line of a command's output, which for
+// kubectl holds the error, or err if there is none.
+func lastLine(out []byte, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if line := strings.TrimSpace(lines[len(lines)-1]); line != "" {
+		return line
+	}
+	return err.Error()
+}
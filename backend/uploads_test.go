@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// testKubeconfig returns a kubeconfig with a dev and a prod context, with user
+// replacing the dev user's fields.
+func testKubeconfig(currentContext, user string) string {
+	return `apiVersion: v1
+kind: Config
+current-context: ` + currentContext + `
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+    certificate-authority-data: Q0E=
+    extensions:
+    - name: client.authentication.k8s.io/exec
+      extension: {}
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+    namespace: team
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+users:
+- name: dev
+  user:
+` + user + `
+- name: prod
+  user:
+    token: prod-token
+`
+}
+
+func TestSanitizeUploadedKubeconfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Uploads.AllowedExecCommands = []string{"aws eks get-token", "gke-gcloud-auth-plugin"}
+	useConfig(t, cfg)
+
+	const awsExec = `    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: aws
+      args: [eks, get-token, --cluster-name, dev]`
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"token", testKubeconfig("dev", "    token: dev-token"), ""},
+		{"client certificate", testKubeconfig("dev", "    client-certificate-data: Q0VSVA==\n    client-key-data: S0VZ"), ""},
+		{"allowed exec", testKubeconfig("dev", awsExec), ""},
+		{"exec without arguments", testKubeconfig("dev", "    exec:\n      command: gke-gcloud-auth-plugin"), ""},
+		{"exec with other subcommand", testKubeconfig("dev", "    exec:\n      command: aws\n      args: [s3, cp, s3://bucket/x, /tmp/x]"), "not allowed"},
+		{"exec with too few arguments", testKubeconfig("dev", "    exec:\n      command: aws\n      args: [eks]"), "not allowed"},
+		{"exec by path", testKubeconfig("dev", "    exec:\n      command: /usr/bin/aws\n      args: [eks, get-token]"), "not allowed"},
+		{"exec setting PATH", testKubeconfig("dev", awsExec+"\n      env:\n      - name: PATH\n        value: /tmp"), "may not set PATH"},
+		{"exec with unknown field", testKubeconfig("dev", awsExec+"\n      installHint: run it"), "unsupported field installHint"},
+		{"auth provider", testKubeconfig("dev", "    auth-provider:\n      name: oidc"), "auth-provider"},
+		{"token file", testKubeconfig("dev", "    tokenFile: /var/run/secrets/token"), "embed it as token"},
+		{"unknown user field", testKubeconfig("dev", "    as: admin"), "unsupported field as"},
+		{"missing user", testKubeconfig("dev", "    token: x\n- name: dev\n  user:\n    token: y"), `user "dev" exactly once`},
+		{"no current context", testKubeconfig("", "    token: dev-token"), "no current-context"},
+		{"unknown current context", testKubeconfig("staging", "    token: dev-token"), `context "staging" exactly once`},
+		{"not yaml", "{", "not a valid kubeconfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := sanitizeUploadedKubeconfig([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("sanitizeUploadedKubeconfig() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeUploadedKubeconfig() error = %v", err)
+			}
+			var kc uploadedKubeconfig
+			if err := yaml.Unmarshal(out, &kc); err != nil {
+				t.Fatalf("sanitized kubeconfig does not parse: %v", err)
+			}
+			if len(kc.Clusters) != 1 || len(kc.Contexts) != 1 || len(kc.Users) != 1 {
+				t.Fatalf("sanitized kubeconfig has %d clusters, %d contexts and %d users, want one of each", len(kc.Clusters), len(kc.Contexts), len(kc.Users))
+			}
+			if kc.CurrentContext != "dev" || kc.Clusters[0].Name != "dev" || kc.Users[0].Name != "dev" {
+				t.Errorf("sanitized kubeconfig kept %q, %q and %q, want dev", kc.CurrentContext, kc.Clusters[0].Name, kc.Users[0].Name)
+			}
+			if kc.Contexts[0].Context.Namespace != "team" {
+				t.Errorf("namespace = %q, want team", kc.Contexts[0].Context.Namespace)
+			}
+			if strings.Contains(string(out), "extensions") {
+				t.Errorf("sanitized kubeconfig kept extensions:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestSanitizeUploadedKubeconfigSingleContext(t *testing.T) {
+	useConfig(t, defaultConfig())
+	data := `apiVersion: v1
+kind: Config
+clusters:
+- name: only
+  cluster:
+    server: https://only.example.com
+contexts:
+- name: only
+  context:
+    cluster: only
+    user: only
+users:
+- name: only
+  user:
+    token: t
+`
+	out, err := sanitizeUploadedKubeconfig([]byte(data))
+	if err != nil {
+		t.Fatalf("sanitizeUploadedKubeconfig() error = %v", err)
+	}
+	if !strings.Contains(string(out), "current-context: only") {
+		t.Errorf("sanitized kubeconfig does not select the only context:\n%s", out)
+	}
+
+	insecure := strings.Replace(data, "https://", "http://", 1)
+	if _, err := sanitizeUploadedKubeconfig([]byte(insecure)); err == nil || !strings.Contains(err.Error(), "https URL") {
+		t.Errorf("sanitizeUploadedKubeconfig(http server) error = %v, want it to require https", err)
+	}
+}